@@ -1,17 +1,37 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"s3ftp/internal/config"
+	"s3ftp/internal/control"
+	"s3ftp/internal/health"
+	"s3ftp/internal/metrics"
 	"s3ftp/internal/rclone"
 	"s3ftp/internal/sftp"
+	"syscall"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			os.Exit(restore(os.Args[2:]))
+		case "sync-now":
+			os.Exit(syncNow(os.Args[2:]))
+		case "sync-once":
+			os.Exit(syncOnce(os.Args[2:]))
+		}
+	}
+
 	slog.Info("starting s3ftp...")
 	env := config.GetEnv()
 
@@ -30,21 +50,142 @@ func main() {
 		os.Exit(1)
 	}
 
-	eg := errgroup.Group{}
-	eg.SetLimit(2)
+	if err := rclone.CheckEndpointTLS(env); err != nil {
+		slog.Error("error checking S3 endpoint TLS", "error", err)
+		os.Exit(1)
+	}
+
+	// S3 may be down at boot, the SFTP server still starts and the first
+	// successful sync cycle marks rclone as configured
+	if err := rclone.CheckRemote(env); err != nil {
+		slog.Warn("error checking rclone configuration, not ready until a sync succeeds", "error", err)
+	}
+
+	if *env.SYNC_RCD {
+		if err := rclone.StartDaemon(env); err != nil {
+			slog.Error("error starting rclone daemon", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Stop gracefully on docker stop (SIGTERM) or Ctrl+C (SIGINT)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+
+	// The group context is also canceled when any of its functions fails,
+	// so the others are stopped too
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(7)
+
+	if env.HTTP_ADDR != nil && *env.HTTP_ADDR != "" {
+		eg.Go(func() error {
+			maxSyncDuration, err := time.ParseDuration(*env.HEALTH_MAX_SYNC_DURATION)
+			if err != nil {
+				return err
+			}
+
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			mux.Handle("/healthz", health.LivenessHandler(maxSyncDuration))
+			mux.Handle("/readyz", health.ReadinessHandler())
+			srv := &http.Server{Addr: *env.HTTP_ADDR, Handler: mux}
+
+			go func() {
+				<-egCtx.Done()
+				_ = srv.Shutdown(context.Background())
+			}()
+
+			slog.Info("HTTP server listening", "addr", *env.HTTP_ADDR)
+			err = srv.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return fmt.Errorf("HTTP server error: %w", err)
+			}
+			return nil
+		})
+	}
 
 	eg.Go(func() error {
-		err := sftp.StartSSHD()
-		return fmt.Errorf("SSHD error: %w", err)
+		if err := sftp.StartSSHD(egCtx, env); err != nil {
+			return fmt.Errorf("SSHD error: %w", err)
+		}
+		if egCtx.Err() == nil {
+			return errors.New("SSHD error: sshd finished unexpectedly")
+		}
+		return nil
 	})
 
 	eg.Go(func() error {
-		err := rclone.RunLoop(env)
-		return fmt.Errorf("rclone error: %w", err)
+		if err := rclone.RunLoop(egCtx, env); err != nil {
+			return fmt.Errorf("rclone error: %w", err)
+		}
+		return nil
 	})
 
+	if *env.SYNC_WATCH {
+		eg.Go(func() error {
+			if err := rclone.RunWatcher(egCtx, env); err != nil {
+				return fmt.Errorf("rclone error: %w", err)
+			}
+			return nil
+		})
+	}
+
+	eg.Go(func() error {
+		return rclone.RunTrashRetention(egCtx, env)
+	})
+
+	eg.Go(func() error {
+		return rclone.PopulateSnapshots(egCtx, env, func(user config.SnapshotUser) error {
+			return sftp.EnableSnapshotUser(user.Username, user.Password)
+		})
+	})
+
+	eg.Go(func() error {
+		handle := func(ctx context.Context, req control.Request) error {
+			if req.Command != control.CommandSyncNow {
+				return fmt.Errorf("unknown command %q", req.Command)
+			}
+			return rclone.SyncNow(ctx, env, req.User)
+		}
+		return control.Serve(egCtx, *env.CONTROL_SOCKET, handle)
+	})
+
+	// SIGUSR1 starts a sync cycle right away
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for {
+			select {
+			case <-egCtx.Done():
+				return
+			case <-usr1:
+				slog.Info("SIGUSR1 received, starting a sync cycle")
+				go func() {
+					if err := rclone.SyncNow(egCtx, env, ""); err != nil && egCtx.Err() == nil {
+						slog.Error("error running requested sync", "error", err)
+					}
+				}()
+			}
+		}
+	}()
+
+	exitCode := 0
 	if err := eg.Wait(); err != nil {
 		slog.Error("error", "error", err)
-		os.Exit(1)
+		exitCode = 1
+	}
+	if ctx.Err() != nil {
+		slog.Info("shutdown signal received")
 	}
+	// A second signal kills the process without waiting for the final sync
+	stop()
+
+	// Push the files uploaded since the last cycle before exiting
+	if err := rclone.FinalSync(env); err != nil {
+		slog.Error("error", "error", err)
+		exitCode = 1
+	}
+	rclone.StopDaemon()
+
+	slog.Info("s3ftp stopped", "exit_code", exitCode)
+	os.Exit(exitCode)
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"s3ftp/internal/config"
+	"s3ftp/internal/rclone"
+	"time"
+)
+
+// restoreUsage is the usage of the restore subcommand
+const restoreUsage = `usage: s3ftp restore <user> <path> [--at time]
+
+Restores a file or directory deleted or overwritten by a user from the trash.
+The path is relative to the user directory. Without --at the last version in
+the trash is restored, with --at (RFC 3339 or YYYY-MM-DD) the version that
+was in place at that time.`
+
+// parseRestoreArgs parses the restore arguments, --at may go before or after
+// the user and path.
+func parseRestoreArgs(args []string) (string, string, time.Time, error) {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), restoreUsage) }
+	atFlag := fs.String("at", "", "restore the version in place at this time")
+
+	if err := fs.Parse(args); err != nil {
+		return "", "", time.Time{}, err
+	}
+	positional := fs.Args()
+	if len(positional) > 2 {
+		if err := fs.Parse(positional[2:]); err != nil {
+			return "", "", time.Time{}, err
+		}
+		if fs.NArg() > 0 {
+			return "", "", time.Time{}, errors.New(restoreUsage)
+		}
+		positional = positional[:2]
+	}
+	if len(positional) != 2 {
+		return "", "", time.Time{}, errors.New(restoreUsage)
+	}
+
+	at := time.Time{}
+	if *atFlag != "" {
+		var err error
+		at, err = time.Parse(time.RFC3339, *atFlag)
+		if err != nil {
+			at, err = time.ParseInLocation(time.DateOnly, *atFlag, time.Local)
+		}
+		if err != nil {
+			return "", "", time.Time{}, fmt.Errorf("invalid --at time %q", *atFlag)
+		}
+	}
+
+	return positional[0], positional[1], at, nil
+}
+
+// restore runs the restore subcommand and returns the exit code.
+func restore(args []string) int {
+	user, path, at, err := parseRestoreArgs(args)
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 2
+	}
+
+	env := config.GetEnv()
+	// The server is running next to it, its configuration is only read
+	if err := rclone.UseConf(env); err != nil {
+		slog.Error("error loading rclone configuration", "error", err)
+		return 1
+	}
+
+	if err := rclone.Restore(env, user, path, at); err != nil {
+		slog.Error("error restoring from trash", "error", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"s3ftp/internal/config"
+	"s3ftp/internal/control"
+)
+
+// syncNowUsage is the usage of the sync-now subcommand
+const syncNowUsage = `usage: s3ftp sync-now [--user user]
+
+Makes the running s3ftp start a sync cycle right away and waits for it to
+finish. With --user only the directory of that user is synced.`
+
+// syncNow runs the sync-now subcommand and returns the exit code.
+func syncNow(args []string) int {
+	fs := flag.NewFlagSet("sync-now", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), syncNowUsage) }
+	user := fs.String("user", "", "sync only the directory of this user")
+	if err := fs.Parse(args); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, syncNowUsage)
+		return 2
+	}
+
+	env := config.GetEnv()
+	req := control.Request{Command: control.CommandSyncNow, User: *user}
+	if err := control.Send(*env.CONTROL_SOCKET, req); err != nil {
+		slog.Error("error running sync", "error", err)
+		return 1
+	}
+
+	slog.Info("sync completed")
+	return 0
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"s3ftp/internal/config"
+	"s3ftp/internal/rclone"
+	"syscall"
+)
+
+// syncOnceUsage is the usage of the sync-once subcommand
+const syncOnceUsage = `usage: s3ftp sync-once [--dry-run]
+
+Runs a single sync cycle with the configured SYNC_MODE and exits, without
+setting up SFTP. It is meant to be run while s3ftp is stopped, use sync-now
+to sync a running instance. With --dry-run nothing is changed, and the files
+that would be copied or deleted are printed per user and direction.`
+
+// syncOnce runs the sync-once subcommand and returns the exit code.
+func syncOnce(args []string) int {
+	fs := flag.NewFlagSet("sync-once", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), syncOnceUsage) }
+	dryRun := fs.Bool("dry-run", false, "only print the changes")
+	if err := fs.Parse(args); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, syncOnceUsage)
+		return 2
+	}
+
+	env := config.GetEnv()
+	if err := rclone.CreateConf(env); err != nil {
+		slog.Error("error creating rclone configuration", "error", err)
+		return 1
+	}
+	if err := rclone.CheckEndpointTLS(env); err != nil {
+		slog.Error("error checking S3 endpoint TLS", "error", err)
+		return 1
+	}
+
+	// Stop retrying on Ctrl+C or docker stop
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	if err := rclone.SyncOnce(ctx, env, *dryRun, os.Stdout); err != nil {
+		slog.Error("error running sync", "error", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,37 @@
+package backoff
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// Delay returns the time to wait before the given retry attempt (starting
+// at 1). It doubles base on every attempt up to max and applies jitter, so
+// retries from several instances don't hit the endpoint at the same time.
+func Delay(attempt int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	// Wait between half and the whole computed delay
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+// Sleep waits for the given duration, it returns false if ctx is done first.
+func Sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,33 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelay(t *testing.T) {
+	base, max := time.Second, 10*time.Second
+
+	// Test the delay grows exponentially and stays within the jitter range
+	for attempt, want := range map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 8 * time.Second,
+	} {
+		for range 20 {
+			d := Delay(attempt, base, max)
+			assert.GreaterOrEqual(t, d, want/2)
+			assert.LessOrEqual(t, d, want)
+		}
+	}
+
+	// Test the delay is capped
+	for range 20 {
+		d := Delay(50, base, max)
+		assert.GreaterOrEqual(t, d, max/2)
+		assert.LessOrEqual(t, d, max)
+	}
+}
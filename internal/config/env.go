@@ -5,16 +5,81 @@ import (
 )
 
 type Env struct {
-	SFTP_USERS *string
+	SFTP_USERS            *string
+	SFTP_SNAPSHOT_USERS   *string
+	SFTP_STARTUP_MODE     *string
+	SFTP_STARTUP_TIMEOUT  *string
+	SFTP_STARTUP_FALLBACK *string
 
+	SSHD_MAX_RESTARTS   *int
+	SSHD_RESTART_WINDOW *string
+
+	SHUTDOWN_DRAIN_TIMEOUT *string
+
+	CONTROL_SOCKET *string
+
+	HTTP_ADDR                *string
+	HEALTH_MAX_SYNC_DURATION *string
+
+	S3_AUTH_MODE         *string
 	S3_ACCESS_KEY_ID     *string
 	S3_SECRET_ACCESS_KEY *string
+	AWS_SESSION_TOKEN    *string
+	S3_ROLE_ARN          *string
 	S3_REGION            *string
 	S3_ENDPOINT          *string
 	S3_BUCKET            *string
+	S3_CONF_MODE         *string
+
+	S3_SSE            *string
+	S3_SSE_KMS_KEY_ID *string
+	S3_SSE_C_KEY      *string
+
+	S3_CA_BUNDLE            *string
+	S3_CLIENT_CERT          *string
+	S3_CLIENT_KEY           *string
+	S3_INSECURE_SKIP_VERIFY *bool
+
+	S3_HTTP_PROXY *string
+	S3_NO_PROXY   *string
+
+	S3_CRYPT_PASSWORD            *string
+	S3_CRYPT_SALT                *string
+	S3_CRYPT_FILENAME_ENCRYPTION *string
+
+	SYNC_INTERVAL         *string
+	SYNC_SCHEDULE         *string
+	SYNC_BLACKOUT_WINDOWS *string
+	SYNC_TIMEZONE         *string
+	SYNC_MODE             *string
+
+	SYNC_SETTLE_TIME    *string
+	SYNC_BISYNC_WORKDIR *string
+
+	SYNC_CONFLICT_RESOLVE *string
+	SYNC_CONFLICT_SUFFIX  *string
+	SYNC_CONFLICTS_DIR    *string
 
-	SYNC_INTERVAL *string
-	SYNC_MODE     *string
+	SYNC_TRASH_PREFIX    *string
+	SYNC_TRASH_RETENTION *string
+
+	SYNC_MAX_DELETE         *int
+	SYNC_MAX_DELETE_PERCENT *int
+	SYNC_CHECK_ACCESS_FILE  *string
+
+	SYNC_WATCH          *bool
+	SYNC_WATCH_DEBOUNCE *string
+
+	SYNC_TIMEOUT       *string
+	SYNC_STALL_TIMEOUT *string
+
+	SYNC_RCD      *bool
+	SYNC_RCD_ADDR *string
+
+	SYNC_RETRIES           *int
+	SYNC_RETRY_BACKOFF     *string
+	SYNC_RETRY_MAX_BACKOFF *string
+	SYNC_MAX_FAILED_CYCLES *int
 }
 
 // GetEnv returns the environment variables.
@@ -31,14 +96,64 @@ func GetEnv() *Env {
 			name:       "SFTP_USERS",
 			isRequired: true,
 		}),
+		SFTP_SNAPSHOT_USERS: getEnvAsString(getEnvAsStringParams{
+			name: "SFTP_SNAPSHOT_USERS",
+		}),
+		SFTP_STARTUP_MODE: getEnvAsString(getEnvAsStringParams{
+			name:         "SFTP_STARTUP_MODE",
+			defaultValue: newDefaultValue(SFTPStartupImmediate),
+		}),
+		SFTP_STARTUP_TIMEOUT: getEnvAsString(getEnvAsStringParams{
+			name:         "SFTP_STARTUP_TIMEOUT",
+			defaultValue: newDefaultValue("10m"),
+		}),
+		SFTP_STARTUP_FALLBACK: getEnvAsString(getEnvAsStringParams{
+			name:         "SFTP_STARTUP_FALLBACK",
+			defaultValue: newDefaultValue(SFTPStartupFallbackOpen),
+		}),
+
+		SSHD_MAX_RESTARTS: getEnvAsInt(getEnvAsIntParams{
+			name:         "SSHD_MAX_RESTARTS",
+			defaultValue: newDefaultValue(5),
+		}),
+		SSHD_RESTART_WINDOW: getEnvAsString(getEnvAsStringParams{
+			name:         "SSHD_RESTART_WINDOW",
+			defaultValue: newDefaultValue("1m"),
+		}),
+
+		SHUTDOWN_DRAIN_TIMEOUT: getEnvAsString(getEnvAsStringParams{
+			name:         "SHUTDOWN_DRAIN_TIMEOUT",
+			defaultValue: newDefaultValue("30s"),
+		}),
+
+		CONTROL_SOCKET: getEnvAsString(getEnvAsStringParams{
+			name:         "CONTROL_SOCKET",
+			defaultValue: newDefaultValue("/run/s3ftp.sock"),
+		}),
 
+		HTTP_ADDR: getEnvAsString(getEnvAsStringParams{
+			name: "HTTP_ADDR",
+		}),
+		HEALTH_MAX_SYNC_DURATION: getEnvAsString(getEnvAsStringParams{
+			name:         "HEALTH_MAX_SYNC_DURATION",
+			defaultValue: newDefaultValue("1h"),
+		}),
+
+		S3_AUTH_MODE: getEnvAsString(getEnvAsStringParams{
+			name:         "S3_AUTH_MODE",
+			defaultValue: newDefaultValue(S3AuthModeStatic),
+		}),
 		S3_ACCESS_KEY_ID: getEnvAsString(getEnvAsStringParams{
-			name:       "S3_ACCESS_KEY_ID",
-			isRequired: true,
+			name: "S3_ACCESS_KEY_ID",
 		}),
 		S3_SECRET_ACCESS_KEY: getEnvAsString(getEnvAsStringParams{
-			name:       "S3_SECRET_ACCESS_KEY",
-			isRequired: true,
+			name: "S3_SECRET_ACCESS_KEY",
+		}),
+		AWS_SESSION_TOKEN: getEnvAsString(getEnvAsStringParams{
+			name: "AWS_SESSION_TOKEN",
+		}),
+		S3_ROLE_ARN: getEnvAsString(getEnvAsStringParams{
+			name: "S3_ROLE_ARN",
 		}),
 		S3_REGION: getEnvAsString(getEnvAsStringParams{
 			name:       "S3_REGION",
@@ -52,15 +167,162 @@ func GetEnv() *Env {
 			name:       "S3_BUCKET",
 			isRequired: true,
 		}),
+		S3_CONF_MODE: getEnvAsString(getEnvAsStringParams{
+			name:         "S3_CONF_MODE",
+			defaultValue: newDefaultValue(S3ConfModeFile),
+		}),
+
+		S3_SSE: getEnvAsString(getEnvAsStringParams{
+			name:         "S3_SSE",
+			defaultValue: newDefaultValue(S3SSENone),
+		}),
+		S3_SSE_KMS_KEY_ID: getEnvAsString(getEnvAsStringParams{
+			name: "S3_SSE_KMS_KEY_ID",
+		}),
+		S3_SSE_C_KEY: getEnvAsSecret(getEnvAsStringParams{
+			name: "S3_SSE_C_KEY",
+		}),
+
+		S3_CA_BUNDLE: getEnvAsString(getEnvAsStringParams{
+			name: "S3_CA_BUNDLE",
+		}),
+		S3_CLIENT_CERT: getEnvAsString(getEnvAsStringParams{
+			name: "S3_CLIENT_CERT",
+		}),
+		S3_CLIENT_KEY: getEnvAsString(getEnvAsStringParams{
+			name: "S3_CLIENT_KEY",
+		}),
+		S3_INSECURE_SKIP_VERIFY: getEnvAsBool(getEnvAsBoolParams{
+			name:         "S3_INSECURE_SKIP_VERIFY",
+			defaultValue: newDefaultValue(false),
+		}),
+
+		S3_HTTP_PROXY: getEnvAsString(getEnvAsStringParams{
+			name: "S3_HTTP_PROXY",
+		}),
+		S3_NO_PROXY: getEnvAsString(getEnvAsStringParams{
+			name: "S3_NO_PROXY",
+		}),
+
+		S3_CRYPT_PASSWORD: getEnvAsSecret(getEnvAsStringParams{
+			name: "S3_CRYPT_PASSWORD",
+		}),
+		S3_CRYPT_SALT: getEnvAsSecret(getEnvAsStringParams{
+			name: "S3_CRYPT_SALT",
+		}),
+		S3_CRYPT_FILENAME_ENCRYPTION: getEnvAsString(getEnvAsStringParams{
+			name:         "S3_CRYPT_FILENAME_ENCRYPTION",
+			defaultValue: newDefaultValue("off"),
+		}),
 
 		SYNC_INTERVAL: getEnvAsString(getEnvAsStringParams{
-			name:       "SYNC_INTERVAL",
-			isRequired: true,
+			name:         "SYNC_INTERVAL",
+			defaultValue: newDefaultValue("15m"),
+		}),
+		SYNC_SCHEDULE: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_SCHEDULE",
+			defaultValue: newDefaultValue(""),
+		}),
+		SYNC_BLACKOUT_WINDOWS: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_BLACKOUT_WINDOWS",
+			defaultValue: newDefaultValue(""),
+		}),
+		SYNC_TIMEZONE: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_TIMEZONE",
+			defaultValue: newDefaultValue("Local"),
 		}),
 		SYNC_MODE: getEnvAsString(getEnvAsStringParams{
 			name:       "SYNC_MODE",
 			isRequired: true,
 		}),
+
+		SYNC_SETTLE_TIME: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_SETTLE_TIME",
+			defaultValue: newDefaultValue("2s"),
+		}),
+		SYNC_BISYNC_WORKDIR: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_BISYNC_WORKDIR",
+			defaultValue: newDefaultValue("/var/lib/s3ftp/bisync"),
+		}),
+
+		SYNC_CONFLICT_RESOLVE: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_CONFLICT_RESOLVE",
+			defaultValue: newDefaultValue(SyncConflictKeepBoth),
+		}),
+		SYNC_CONFLICT_SUFFIX: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_CONFLICT_SUFFIX",
+			defaultValue: newDefaultValue("conflict"),
+		}),
+		SYNC_CONFLICTS_DIR: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_CONFLICTS_DIR",
+			defaultValue: newDefaultValue(""),
+		}),
+
+		SYNC_TRASH_PREFIX: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_TRASH_PREFIX",
+			defaultValue: newDefaultValue(""),
+		}),
+		SYNC_TRASH_RETENTION: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_TRASH_RETENTION",
+			defaultValue: newDefaultValue("720h"),
+		}),
+
+		SYNC_MAX_DELETE: getEnvAsInt(getEnvAsIntParams{
+			name:         "SYNC_MAX_DELETE",
+			defaultValue: newDefaultValue(0),
+		}),
+		SYNC_MAX_DELETE_PERCENT: getEnvAsInt(getEnvAsIntParams{
+			name:         "SYNC_MAX_DELETE_PERCENT",
+			defaultValue: newDefaultValue(0),
+		}),
+		SYNC_CHECK_ACCESS_FILE: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_CHECK_ACCESS_FILE",
+			defaultValue: newDefaultValue(""),
+		}),
+
+		SYNC_WATCH: getEnvAsBool(getEnvAsBoolParams{
+			name:         "SYNC_WATCH",
+			defaultValue: newDefaultValue(false),
+		}),
+		SYNC_WATCH_DEBOUNCE: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_WATCH_DEBOUNCE",
+			defaultValue: newDefaultValue("5s"),
+		}),
+
+		SYNC_TIMEOUT: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_TIMEOUT",
+			defaultValue: newDefaultValue("0s"),
+		}),
+		SYNC_STALL_TIMEOUT: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_STALL_TIMEOUT",
+			defaultValue: newDefaultValue("10m"),
+		}),
+
+		SYNC_RCD: getEnvAsBool(getEnvAsBoolParams{
+			name:         "SYNC_RCD",
+			defaultValue: newDefaultValue(false),
+		}),
+		SYNC_RCD_ADDR: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_RCD_ADDR",
+			defaultValue: newDefaultValue("127.0.0.1:5572"),
+		}),
+
+		SYNC_RETRIES: getEnvAsInt(getEnvAsIntParams{
+			name:         "SYNC_RETRIES",
+			defaultValue: newDefaultValue(3),
+		}),
+		SYNC_RETRY_BACKOFF: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_RETRY_BACKOFF",
+			defaultValue: newDefaultValue("5s"),
+		}),
+		SYNC_RETRY_MAX_BACKOFF: getEnvAsString(getEnvAsStringParams{
+			name:         "SYNC_RETRY_MAX_BACKOFF",
+			defaultValue: newDefaultValue("2m"),
+		}),
+		SYNC_MAX_FAILED_CYCLES: getEnvAsInt(getEnvAsIntParams{
+			name:         "SYNC_MAX_FAILED_CYCLES",
+			defaultValue: newDefaultValue(5),
+		}),
 	}
 
 	validateEnv(env)
@@ -2,8 +2,10 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 )
 
 type getEnvAsStringParams struct {
@@ -54,6 +56,43 @@ func getEnvAsStringFunc(params getEnvAsStringParams) (*string, error) {
 	return &value, nil
 }
 
+// getEnvAsSecret returns the value of the environment variable with the given
+// name, or the content of the file pointed by <name>_FILE (e.g. Docker or
+// Kubernetes secrets).
+func getEnvAsSecret(params getEnvAsStringParams) *string {
+	value, err := getEnvAsSecretFunc(params)
+
+	if err != nil {
+		logFatalError(
+			"error getting env variable",
+			"name", params.name,
+			"error", err,
+		)
+	}
+
+	return value
+}
+
+// getEnvAsSecretFunc is the outlying function for getEnvAsSecret.
+func getEnvAsSecretFunc(params getEnvAsStringParams) (*string, error) {
+	path, fileExists := os.LookupEnv(params.name + "_FILE")
+	if !fileExists {
+		return getEnvAsStringFunc(params)
+	}
+
+	if _, exists := os.LookupEnv(params.name); exists {
+		return nil, fmt.Errorf("cannot set both %s and %s_FILE", params.name, params.name)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s_FILE: %w", params.name, err)
+	}
+
+	value := strings.TrimRight(string(b), "\r\n")
+	return &value, nil
+}
+
 type getEnvAsIntParams struct {
 	name         string
 	defaultValue *int
@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -74,6 +75,54 @@ func TestGetEnvAsStringFunc(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestGetEnvAsSecretFunc(t *testing.T) {
+	// Test when environment variable exists
+	os.Setenv("TEST_SECRET", "plain_value")
+	value, err := getEnvAsSecretFunc(getEnvAsStringParams{
+		name: "TEST_SECRET",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "plain_value", *value)
+	os.Unsetenv("TEST_SECRET")
+
+	// Test when the _FILE variant points to a file, trailing newline is trimmed
+	path := filepath.Join(t.TempDir(), "secret")
+	assert.NoError(t, os.WriteFile(path, []byte("file_value\n"), 0600))
+	os.Setenv("TEST_SECRET_FILE", path)
+	value, err = getEnvAsSecretFunc(getEnvAsStringParams{
+		name:       "TEST_SECRET",
+		isRequired: true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "file_value", *value)
+
+	// Test when both variants are set
+	// This should return an error
+	os.Setenv("TEST_SECRET", "plain_value")
+	_, err = getEnvAsSecretFunc(getEnvAsStringParams{
+		name: "TEST_SECRET",
+	})
+	assert.Error(t, err)
+	os.Unsetenv("TEST_SECRET")
+	os.Unsetenv("TEST_SECRET_FILE")
+
+	// Test when the _FILE variant points to a missing file
+	// This should return an error
+	os.Setenv("TEST_SECRET_FILE", filepath.Join(t.TempDir(), "missing"))
+	_, err = getEnvAsSecretFunc(getEnvAsStringParams{
+		name: "TEST_SECRET",
+	})
+	assert.Error(t, err)
+	os.Unsetenv("TEST_SECRET_FILE")
+
+	// Test when no variant exists and is not required
+	value, err = getEnvAsSecretFunc(getEnvAsStringParams{
+		name: "TEST_SECRET",
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+}
+
 func TestGetEnvAsIntFunc(t *testing.T) {
 	// Test when environment variable exists and is an integer
 	os.Setenv("TEST_ENV", "123")
@@ -13,3 +13,7 @@ func logFatalError(msg string, args ...any) {
 func logInfo(msg string, args ...any) {
 	slog.Info(msg, args...)
 }
+
+func logWarn(msg string, args ...any) {
+	slog.Warn(msg, args...)
+}
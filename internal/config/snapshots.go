@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SnapshotUser is a read-only SFTP user that serves the directory of another
+// user as it was at a past time, rebuilt from the S3 object versions
+type SnapshotUser struct {
+	Username string
+	Password string
+	User     string
+	At       time.Time
+}
+
+// SnapshotUsers parses SFTP_SNAPSHOT_USERS, a comma separated list of
+// username:password:user:time entries where time is RFC 3339, e.g.
+// "audit1:pass:partner1:2024-06-01T00:00:00Z".
+func SnapshotUsers(env *Env) ([]SnapshotUser, error) {
+	if env.SFTP_SNAPSHOT_USERS == nil || *env.SFTP_SNAPSHOT_USERS == "" {
+		return nil, nil
+	}
+
+	users := []SnapshotUser{}
+	for i, entry := range strings.Split(*env.SFTP_SNAPSHOT_USERS, ",") {
+		// The time contains colons, so it takes the rest of the entry
+		segments := strings.SplitN(entry, ":", 4)
+		if len(segments) != 4 || segments[0] == "" || segments[1] == "" || segments[2] == "" {
+			// The entry holds a password, so only its position is reported
+			return nil, fmt.Errorf("invalid entry %d, must be username:password:user:time", i+1)
+		}
+
+		// The source user is a directory name under the local root
+		if strings.Contains(segments[2], "/") || strings.HasPrefix(segments[2], ".") {
+			return nil, fmt.Errorf("invalid user in entry for %s", segments[0])
+		}
+
+		at, err := time.Parse(time.RFC3339, segments[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid time in entry for %s, must be RFC 3339", segments[0])
+		}
+		if at.After(time.Now()) {
+			return nil, fmt.Errorf("time in entry for %s is in the future", segments[0])
+		}
+
+		users = append(users, SnapshotUser{
+			Username: segments[0],
+			Password: segments[1],
+			User:     segments[2],
+			At:       at,
+		})
+	}
+
+	return users, nil
+}
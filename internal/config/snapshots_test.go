@@ -0,0 +1,59 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotUsers(t *testing.T) {
+	env := &Env{}
+
+	// Test no snapshot users
+	users, err := SnapshotUsers(env)
+	assert.NoError(t, err)
+	assert.Empty(t, users)
+
+	// Test the time keeps its colons
+	value := "audit1:pass1:partner1:2024-06-01T00:00:00Z,audit2:pass2:partner2:2024-06-01T10:30:00+02:00"
+	env.SFTP_SNAPSHOT_USERS = &value
+	users, err = SnapshotUsers(env)
+	assert.NoError(t, err)
+	assert.Equal(t, []SnapshotUser{
+		{
+			Username: "audit1",
+			Password: "pass1",
+			User:     "partner1",
+			At:       time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Username: "audit2",
+			Password: "pass2",
+			User:     "partner2",
+			At:       time.Date(2024, 6, 1, 10, 30, 0, 0, time.FixedZone("", 2*60*60)),
+		},
+	}, users)
+
+	// Test invalid entries
+	for _, value := range []string{
+		"audit1:pass1:partner1",
+		"audit1:pass1::2024-06-01T00:00:00Z",
+		"audit1:pass1:partner1:2024-06-01",
+		"audit1:pass1:partner1:2999-01-01T00:00:00Z",
+		"audit1:pass1:..:2024-06-01T00:00:00Z",
+		"audit1:pass1:.:2024-06-01T00:00:00Z",
+		"audit1:pass1:partner1/../..:2024-06-01T00:00:00Z",
+		"audit1:pass1:/:2024-06-01T00:00:00Z",
+	} {
+		env.SFTP_SNAPSHOT_USERS = &value
+		_, err := SnapshotUsers(env)
+		assert.Error(t, err, value)
+	}
+
+	// Test the password is never part of the error
+	value = "audit1:secret1:partner1"
+	env.SFTP_SNAPSHOT_USERS = &value
+	_, err = SnapshotUsers(env)
+	assert.EqualError(t, err, "invalid entry 1, must be username:password:user:time")
+}
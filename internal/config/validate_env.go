@@ -1,14 +1,88 @@
 package config
 
 import (
+	"encoding/base64"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"s3ftp/internal/schedule"
+	"strings"
 	"time"
 )
 
+const (
+	// SFTPStartupImmediate starts sshd and accepts logins right away
+	SFTPStartupImmediate = "immediate"
+	// SFTPStartupHold starts sshd right away but refuses logins with a
+	// banner until the initial sync has finished
+	SFTPStartupHold = "hold"
+	// SFTPStartupDelay starts sshd only after the initial sync has finished
+	SFTPStartupDelay = "delay"
+
+	// SFTPStartupFallbackOpen accepts logins if the initial sync times out
+	SFTPStartupFallbackOpen = "open"
+	// SFTPStartupFallbackExit exits if the initial sync times out
+	SFTPStartupFallbackExit = "exit"
+
+	// S3AuthModeStatic uses the S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY keys
+	S3AuthModeStatic = "static"
+	// S3AuthModeEnv lets rclone pick up ambient AWS credentials (env vars,
+	// web identity tokens, ECS task roles or EC2 instance profiles)
+	S3AuthModeEnv = "env"
+
+	// S3ConfModeFile writes the rclone remotes to the rclone.conf file
+	S3ConfModeFile = "file"
+	// S3ConfModeEnv passes the rclone remotes to each rclone process through
+	// RCLONE_CONFIG_* env vars, so no credentials are written to disk
+	S3ConfModeEnv = "env"
+
+	// SyncConflictKeepBoth keeps both versions of a file changed locally and
+	// in S3, renamed with SYNC_CONFLICT_SUFFIX
+	SyncConflictKeepBoth = "keep-both"
+	// SyncConflictNewer keeps the most recently modified version
+	SyncConflictNewer = "newer"
+	// SyncConflictS3 keeps the version in S3
+	SyncConflictS3 = "s3"
+	// SyncConflictLocal keeps the local version
+	SyncConflictLocal = "local"
+
+	// S3SSENone leaves server-side encryption to the bucket defaults
+	S3SSENone = "none"
+	// S3SSES3 encrypts objects with keys managed by S3 (AES256)
+	S3SSES3 = "sse-s3"
+	// S3SSEKMS encrypts objects with a KMS key (aws:kms)
+	S3SSEKMS = "sse-kms"
+	// S3SSEC encrypts objects with a key provided on every request
+	S3SSEC = "sse-c"
+)
+
 func validateEnv(env *Env) {
 	validateSftpUsers(env)
+	validateSftpSnapshotUsers(env)
+	validateSftpStartup(env)
+	validateSSHDRestarts(env)
+	validateShutdown(env)
+	validateControlSocket(env)
+	validateHTTPAddr(env)
+	validateS3Auth(env)
+	validateS3ConfMode(env)
+	validateS3SSE(env)
+	validateS3TLS(env)
+	validateS3Proxy(env)
+	validateS3Crypt(env)
 	validateSyncInterval(env)
 	validateSyncMode(env)
+	validateSyncBisyncWorkdir(env)
+	validateSyncConflicts(env)
+	validateSyncTrash(env)
+	validateSyncSettleTime(env)
+	validateSyncSafety(env)
+	validateSyncWatch(env)
+	validateSyncTimeouts(env)
+	validateSyncRcd(env)
+	validateSyncRetries(env)
 }
 
 func validateSftpUsers(env *Env) {
@@ -21,14 +95,239 @@ func validateSftpUsers(env *Env) {
 	}
 }
 
+func validateSftpSnapshotUsers(env *Env) {
+	if env.SFTP_SNAPSHOT_USERS == nil || *env.SFTP_SNAPSHOT_USERS == "" {
+		return
+	}
+
+	re := regexp.MustCompile(`^[a-zA-Z0-9_\-:@/.,+]+$`)
+	if !re.MatchString(*env.SFTP_SNAPSHOT_USERS) {
+		// The value holds passwords, so it is not logged
+		logFatalError("SFTP_SNAPSHOT_USERS contains invalid characters")
+	}
+
+	if _, err := SnapshotUsers(env); err != nil {
+		logFatalError("SFTP_SNAPSHOT_USERS is invalid", "error", err)
+	}
+}
+
+func validateSftpStartup(env *Env) {
+	mode := *env.SFTP_STARTUP_MODE
+	if mode != SFTPStartupImmediate && mode != SFTPStartupHold && mode != SFTPStartupDelay {
+		logFatalError(
+			"SFTP_STARTUP_MODE is invalid, must be 'immediate', 'hold' or 'delay'",
+			"value", mode,
+		)
+	}
+
+	d, err := time.ParseDuration(*env.SFTP_STARTUP_TIMEOUT)
+	if err != nil || d <= 0 {
+		logFatalError("SFTP_STARTUP_TIMEOUT is invalid", "value", *env.SFTP_STARTUP_TIMEOUT)
+	}
+
+	fallback := *env.SFTP_STARTUP_FALLBACK
+	if fallback != SFTPStartupFallbackOpen && fallback != SFTPStartupFallbackExit {
+		logFatalError(
+			"SFTP_STARTUP_FALLBACK is invalid, must be 'open' or 'exit'",
+			"value", fallback,
+		)
+	}
+}
+
+func validateSSHDRestarts(env *Env) {
+	if *env.SSHD_MAX_RESTARTS < 0 {
+		logFatalError("SSHD_MAX_RESTARTS must be 0 or greater", "value", *env.SSHD_MAX_RESTARTS)
+	}
+
+	d, err := time.ParseDuration(*env.SSHD_RESTART_WINDOW)
+	if err != nil || d <= 0 {
+		logFatalError("SSHD_RESTART_WINDOW is invalid", "value", *env.SSHD_RESTART_WINDOW)
+	}
+}
+
+func validateShutdown(env *Env) {
+	d, err := time.ParseDuration(*env.SHUTDOWN_DRAIN_TIMEOUT)
+	if err != nil || d < 0 {
+		logFatalError("SHUTDOWN_DRAIN_TIMEOUT is invalid", "value", *env.SHUTDOWN_DRAIN_TIMEOUT)
+	}
+}
+
+func validateControlSocket(env *Env) {
+	if !filepath.IsAbs(*env.CONTROL_SOCKET) {
+		logFatalError("CONTROL_SOCKET must be an absolute path", "value", *env.CONTROL_SOCKET)
+	}
+}
+
+func validateHTTPAddr(env *Env) {
+	d, err := time.ParseDuration(*env.HEALTH_MAX_SYNC_DURATION)
+	if err != nil || d <= 0 {
+		logFatalError(
+			"HEALTH_MAX_SYNC_DURATION is invalid",
+			"value", *env.HEALTH_MAX_SYNC_DURATION,
+		)
+	}
+
+	if env.HTTP_ADDR == nil || *env.HTTP_ADDR == "" {
+		return
+	}
+
+	if _, _, err := net.SplitHostPort(*env.HTTP_ADDR); err != nil {
+		logFatalError(
+			"HTTP_ADDR is invalid, must be host:port or :port",
+			"value", *env.HTTP_ADDR,
+			"error", err,
+		)
+	}
+}
+
+func validateS3Auth(env *Env) {
+	if *env.S3_AUTH_MODE != S3AuthModeStatic && *env.S3_AUTH_MODE != S3AuthModeEnv {
+		logFatalError(
+			"S3_AUTH_MODE is invalid, must be 'static' or 'env'",
+			"value", *env.S3_AUTH_MODE,
+		)
+	}
+
+	if *env.S3_AUTH_MODE != S3AuthModeStatic {
+		return
+	}
+
+	if env.S3_ACCESS_KEY_ID == nil || *env.S3_ACCESS_KEY_ID == "" {
+		logFatalError("S3_ACCESS_KEY_ID is required when S3_AUTH_MODE is 'static'")
+	}
+	if env.S3_SECRET_ACCESS_KEY == nil || *env.S3_SECRET_ACCESS_KEY == "" {
+		logFatalError("S3_SECRET_ACCESS_KEY is required when S3_AUTH_MODE is 'static'")
+	}
+}
+
+func validateS3ConfMode(env *Env) {
+	if *env.S3_CONF_MODE != S3ConfModeFile && *env.S3_CONF_MODE != S3ConfModeEnv {
+		logFatalError(
+			"S3_CONF_MODE is invalid, must be 'file' or 'env'",
+			"value", *env.S3_CONF_MODE,
+		)
+	}
+}
+
+func validateS3SSE(env *Env) {
+	mode := *env.S3_SSE
+	if mode != S3SSENone && mode != S3SSES3 && mode != S3SSEKMS && mode != S3SSEC {
+		logFatalError(
+			"S3_SSE is invalid, must be 'none', 'sse-s3', 'sse-kms' or 'sse-c'",
+			"value", mode,
+		)
+	}
+
+	hasKMSKey := env.S3_SSE_KMS_KEY_ID != nil && *env.S3_SSE_KMS_KEY_ID != ""
+	hasCKey := env.S3_SSE_C_KEY != nil && *env.S3_SSE_C_KEY != ""
+
+	if hasKMSKey && mode != S3SSEKMS {
+		logFatalError("S3_SSE_KMS_KEY_ID requires S3_SSE to be 'sse-kms'", "value", mode)
+	}
+	if hasCKey && mode != S3SSEC {
+		logFatalError("S3_SSE_C_KEY requires S3_SSE to be 'sse-c'", "value", mode)
+	}
+
+	if mode == S3SSEC {
+		if !hasCKey {
+			logFatalError("S3_SSE_C_KEY is required when S3_SSE is 'sse-c'")
+		}
+		key, err := base64.StdEncoding.DecodeString(*env.S3_SSE_C_KEY)
+		if err != nil || len(key) != 32 {
+			// The key is a secret, so it is not logged
+			logFatalError("S3_SSE_C_KEY must be a base64 encoded 256-bit key")
+		}
+	}
+}
+
+func validateS3TLS(env *Env) {
+	hasCert := env.S3_CLIENT_CERT != nil && *env.S3_CLIENT_CERT != ""
+	hasKey := env.S3_CLIENT_KEY != nil && *env.S3_CLIENT_KEY != ""
+	if hasCert != hasKey {
+		logFatalError("S3_CLIENT_CERT and S3_CLIENT_KEY must be set together")
+	}
+
+	files := map[string]*string{
+		"S3_CA_BUNDLE":   env.S3_CA_BUNDLE,
+		"S3_CLIENT_CERT": env.S3_CLIENT_CERT,
+		"S3_CLIENT_KEY":  env.S3_CLIENT_KEY,
+	}
+	for name, path := range files {
+		if path == nil || *path == "" {
+			continue
+		}
+		if _, err := os.Stat(*path); err != nil {
+			logFatalError(
+				name+" file is not readable",
+				"value", *path,
+				"error", err,
+			)
+		}
+	}
+
+	if *env.S3_INSECURE_SKIP_VERIFY {
+		logWarn("⚠️ S3_INSECURE_SKIP_VERIFY is enabled, TLS certificates will not be verified")
+	}
+}
+
+func validateS3Proxy(env *Env) {
+	if env.S3_HTTP_PROXY == nil || *env.S3_HTTP_PROXY == "" {
+		return
+	}
+
+	u, err := url.Parse(*env.S3_HTTP_PROXY)
+	if err != nil || u.Host == "" {
+		// The raw value may contain credentials, so it is not logged
+		logFatalError("S3_HTTP_PROXY is not a valid URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+		logFatalError(
+			"S3_HTTP_PROXY scheme is invalid, must be 'http', 'https' or 'socks5'",
+			"value", u.Redacted(),
+		)
+	}
+
+	logInfo("using outbound proxy for S3 traffic", "proxy", u.Redacted())
+}
+
+func validateS3Crypt(env *Env) {
+	hasPassword := env.S3_CRYPT_PASSWORD != nil && *env.S3_CRYPT_PASSWORD != ""
+	hasSalt := env.S3_CRYPT_SALT != nil && *env.S3_CRYPT_SALT != ""
+	if hasSalt && !hasPassword {
+		logFatalError("S3_CRYPT_SALT requires S3_CRYPT_PASSWORD")
+	}
+
+	mode := *env.S3_CRYPT_FILENAME_ENCRYPTION
+	if mode != "standard" && mode != "obfuscate" && mode != "off" {
+		logFatalError(
+			"S3_CRYPT_FILENAME_ENCRYPTION is invalid, must be 'standard', 'obfuscate' or 'off'",
+			"value", mode,
+		)
+	}
+
+	if hasPassword {
+		logInfo("client-side encryption enabled", "filename_encryption", mode)
+	}
+}
+
 func validateSyncInterval(env *Env) {
-	_, err := time.ParseDuration(*env.SYNC_INTERVAL)
-	if err != nil {
+	interval, err := time.ParseDuration(*env.SYNC_INTERVAL)
+	if err != nil || interval <= 0 {
 		logFatalError(
 			"SYNC_INTERVAL is invalid",
 			"value", *env.SYNC_INTERVAL,
 		)
 	}
+
+	_, err = schedule.Parse(
+		interval, *env.SYNC_SCHEDULE, *env.SYNC_BLACKOUT_WINDOWS, *env.SYNC_TIMEZONE,
+	)
+	if err != nil {
+		logFatalError(
+			"SYNC_SCHEDULE, SYNC_BLACKOUT_WINDOWS or SYNC_TIMEZONE is invalid",
+			"error", err,
+		)
+	}
 }
 
 func validateSyncMode(env *Env) {
@@ -39,3 +338,179 @@ func validateSyncMode(env *Env) {
 		)
 	}
 }
+
+func validateSyncBisyncWorkdir(env *Env) {
+	if !filepath.IsAbs(*env.SYNC_BISYNC_WORKDIR) {
+		logFatalError(
+			"SYNC_BISYNC_WORKDIR must be an absolute path",
+			"value", *env.SYNC_BISYNC_WORKDIR,
+		)
+	}
+
+	// The bisync state is kept inside the synced directory otherwise
+	rel, err := filepath.Rel("/home", *env.SYNC_BISYNC_WORKDIR)
+	if err == nil && !strings.HasPrefix(rel, "..") {
+		logFatalError(
+			"SYNC_BISYNC_WORKDIR must be outside /home",
+			"value", *env.SYNC_BISYNC_WORKDIR,
+		)
+	}
+}
+
+func validateSyncConflicts(env *Env) {
+	resolve := *env.SYNC_CONFLICT_RESOLVE
+	if resolve != SyncConflictKeepBoth && resolve != SyncConflictNewer &&
+		resolve != SyncConflictS3 && resolve != SyncConflictLocal {
+		logFatalError(
+			"SYNC_CONFLICT_RESOLVE is invalid, must be 'keep-both', 'newer', 's3' or 'local'",
+			"value", resolve,
+		)
+	}
+
+	re := regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
+	if !re.MatchString(*env.SYNC_CONFLICT_SUFFIX) {
+		logFatalError(
+			"SYNC_CONFLICT_SUFFIX contains invalid characters",
+			"value", *env.SYNC_CONFLICT_SUFFIX,
+		)
+	}
+
+	dir := *env.SYNC_CONFLICTS_DIR
+	if dir == "" {
+		return
+	}
+	if !filepath.IsLocal(dir) {
+		logFatalError(
+			"SYNC_CONFLICTS_DIR must be a relative path inside the user directory",
+			"value", dir,
+		)
+	}
+	// With keep-both there is no losing version to move
+	if resolve == SyncConflictKeepBoth {
+		logFatalError(
+			"SYNC_CONFLICTS_DIR requires SYNC_CONFLICT_RESOLVE to be 'newer', 's3' or 'local'",
+			"value", resolve,
+		)
+	}
+}
+
+func validateSyncTrash(env *Env) {
+	d, err := time.ParseDuration(*env.SYNC_TRASH_RETENTION)
+	if err != nil || d < 0 {
+		logFatalError("SYNC_TRASH_RETENTION is invalid", "value", *env.SYNC_TRASH_RETENTION)
+	}
+
+	prefix := *env.SYNC_TRASH_PREFIX
+	if prefix == "" {
+		return
+	}
+	if !filepath.IsLocal(prefix) {
+		logFatalError("SYNC_TRASH_PREFIX must be a relative path in the bucket", "value", prefix)
+	}
+
+	// In sync mode nothing is deleted or overwritten in S3
+	if *env.SYNC_MODE != "bisync" {
+		logFatalError("SYNC_TRASH_PREFIX requires SYNC_MODE to be 'bisync'", "value", *env.SYNC_MODE)
+	}
+}
+
+func validateSyncSettleTime(env *Env) {
+	d, err := time.ParseDuration(*env.SYNC_SETTLE_TIME)
+	if err != nil || d < 0 {
+		logFatalError("SYNC_SETTLE_TIME is invalid", "value", *env.SYNC_SETTLE_TIME)
+	}
+}
+
+func validateSyncSafety(env *Env) {
+	if *env.SYNC_MAX_DELETE < 0 {
+		logFatalError("SYNC_MAX_DELETE must be 0 or greater", "value", *env.SYNC_MAX_DELETE)
+	}
+	if *env.SYNC_MAX_DELETE_PERCENT < 0 || *env.SYNC_MAX_DELETE_PERCENT > 100 {
+		logFatalError(
+			"SYNC_MAX_DELETE_PERCENT must be between 0 and 100",
+			"value", *env.SYNC_MAX_DELETE_PERCENT,
+		)
+	}
+
+	if strings.ContainsAny(*env.SYNC_CHECK_ACCESS_FILE, "/\\") {
+		logFatalError(
+			"SYNC_CHECK_ACCESS_FILE must be a file name at the root of the bucket",
+			"value", *env.SYNC_CHECK_ACCESS_FILE,
+		)
+	}
+}
+
+func validateSyncWatch(env *Env) {
+	d, err := time.ParseDuration(*env.SYNC_WATCH_DEBOUNCE)
+	if err != nil || d <= 0 {
+		logFatalError("SYNC_WATCH_DEBOUNCE is invalid", "value", *env.SYNC_WATCH_DEBOUNCE)
+	}
+
+	// In sync mode S3 is mirrored into the local directory, so a pushed file
+	// would be deleted by the next cycle
+	if *env.SYNC_WATCH && *env.SYNC_MODE != "bisync" {
+		logFatalError("SYNC_WATCH requires SYNC_MODE to be 'bisync'", "value", *env.SYNC_MODE)
+	}
+}
+
+func validateSyncTimeouts(env *Env) {
+	d, err := time.ParseDuration(*env.SYNC_TIMEOUT)
+	if err != nil || d < 0 {
+		logFatalError("SYNC_TIMEOUT is invalid", "value", *env.SYNC_TIMEOUT)
+	}
+
+	// rclone reports its progress every minute, a shorter stall timeout
+	// would kill healthy runs
+	d, err = time.ParseDuration(*env.SYNC_STALL_TIMEOUT)
+	if err != nil || (d != 0 && d < 2*time.Minute) {
+		logFatalError(
+			"SYNC_STALL_TIMEOUT is invalid, must be 0s or at least 2m",
+			"value", *env.SYNC_STALL_TIMEOUT,
+		)
+	}
+}
+
+func validateSyncRcd(env *Env) {
+	if !*env.SYNC_RCD {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(*env.SYNC_RCD_ADDR)
+	if err != nil {
+		logFatalError(
+			"SYNC_RCD_ADDR is invalid, must be host:port",
+			"value", *env.SYNC_RCD_ADDR,
+			"error", err,
+		)
+	}
+
+	// The remote control API can read and write the whole bucket
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		logFatalError("SYNC_RCD_ADDR must be a loopback address", "value", *env.SYNC_RCD_ADDR)
+	}
+}
+
+func validateSyncRetries(env *Env) {
+	if *env.SYNC_RETRIES < 0 {
+		logFatalError("SYNC_RETRIES must be 0 or greater", "value", *env.SYNC_RETRIES)
+	}
+	if *env.SYNC_MAX_FAILED_CYCLES < 0 {
+		logFatalError(
+			"SYNC_MAX_FAILED_CYCLES must be 0 or greater",
+			"value", *env.SYNC_MAX_FAILED_CYCLES,
+		)
+	}
+
+	backoff, err := time.ParseDuration(*env.SYNC_RETRY_BACKOFF)
+	if err != nil || backoff <= 0 {
+		logFatalError("SYNC_RETRY_BACKOFF is invalid", "value", *env.SYNC_RETRY_BACKOFF)
+	}
+	maxBackoff, err := time.ParseDuration(*env.SYNC_RETRY_MAX_BACKOFF)
+	if err != nil || maxBackoff < backoff {
+		logFatalError(
+			"SYNC_RETRY_MAX_BACKOFF is invalid, must be greater than SYNC_RETRY_BACKOFF",
+			"value", *env.SYNC_RETRY_MAX_BACKOFF,
+		)
+	}
+}
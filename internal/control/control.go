@@ -0,0 +1,115 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+)
+
+// CommandSyncNow runs a sync cycle right away
+const CommandSyncNow = "sync-now"
+
+// Request is a command sent to the running process
+type Request struct {
+	Command string `json:"command"`
+	User    string `json:"user,omitempty"`
+}
+
+// Response is the result of a command, Error is empty if it succeeded
+type Response struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Handler runs a command and returns its error
+type Handler func(ctx context.Context, req Request) error
+
+// Serve listens on the unix socket at path and runs every request received
+// with handle, until ctx is done. It only returns once the requests in
+// progress have been handled. The socket is only accessible by the user
+// running the process.
+func Serve(ctx context.Context, path string, handle Handler) error {
+	// A socket left behind by a previous process would make Listen fail
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing stale control socket: %w", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("error listening on control socket: %w", err)
+	}
+	defer l.Close()
+	if err := os.Chmod(path, 0600); err != nil {
+		return fmt.Errorf("error setting control socket permissions: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+
+	// Wait for the handlers, so none outlives the process shutdown
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+
+	slog.Info("control socket listening", "path", path)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("error accepting control connection: %w", err)
+		}
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			serveConn(ctx, conn, handle)
+		}()
+	}
+}
+
+// serveConn runs the request received on conn and writes back its response.
+func serveConn(ctx context.Context, conn net.Conn, handle Handler) {
+	defer conn.Close()
+
+	req := Request{}
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		_ = json.NewEncoder(conn).Encode(Response{Error: "invalid request"})
+		return
+	}
+
+	slog.Info("control command received", "command", req.Command, "user", req.User)
+	res := Response{}
+	if err := handle(ctx, req); err != nil {
+		res.Error = err.Error()
+	}
+	_ = json.NewEncoder(conn).Encode(res)
+}
+
+// Send sends the request to the process listening on the unix socket at path
+// and waits for its response. It returns the error of the command, if any.
+func Send(path string, req Request) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("error connecting to s3ftp, is it running? %w", err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("error sending command: %w", err)
+	}
+
+	res := Response{}
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		return fmt.Errorf("error reading response: %w", err)
+	}
+	if res.Error != "" {
+		return errors.New(res.Error)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeAndSend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s3ftp.sock")
+
+	// A stale socket file is replaced
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Serve(ctx, path, func(_ context.Context, req Request) error {
+			if req.User == "unknown" {
+				return errors.New("unknown user")
+			}
+			return nil
+		})
+	}()
+	require.Eventually(t, func() bool {
+		info, err := os.Stat(path)
+		return err == nil && info.Mode()&os.ModeSocket != 0
+	}, time.Second, 10*time.Millisecond)
+
+	// Test the socket is only accessible by its owner
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Test the command result is returned to the sender
+	assert.NoError(t, Send(path, Request{Command: CommandSyncNow}))
+	assert.EqualError(t, Send(path, Request{Command: CommandSyncNow, User: "unknown"}), "unknown user")
+
+	// Test it stops when ctx is done
+	cancel()
+	select {
+	case err := <-errc:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("serve did not stop")
+	}
+
+	// Test sending without a running process
+	assert.ErrorContains(t, Send(path, Request{Command: CommandSyncNow}), "is it running?")
+}
+
+func TestServeWaitsForHandlers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s3ftp.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	release := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Serve(ctx, path, func(_ context.Context, _ Request) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	sent := make(chan error, 1)
+	go func() { sent <- Send(path, Request{Command: CommandSyncNow}) }()
+	<-started
+
+	// Test it doesn't return while a request is being handled
+	cancel()
+	select {
+	case <-errc:
+		t.Fatal("serve returned with a request in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	assert.NoError(t, <-errc)
+	assert.NoError(t, <-sent)
+}
@@ -0,0 +1,134 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// state is the process state published by the SFTP setup, sshd and the
+// sync loop
+var state = struct {
+	mu sync.Mutex
+
+	usersProvisioned bool
+	rcloneConfigured bool
+	sshdRunning      bool
+	initialSyncDone  bool
+
+	syncRunning   bool
+	syncStartedAt time.Time
+
+	initialSync chan struct{}
+}{
+	initialSync: make(chan struct{}),
+}
+
+// SetUsersProvisioned records that the SFTP users have been created.
+func SetUsersProvisioned() {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.usersProvisioned = true
+}
+
+// SetRcloneConfigured records that the rclone configuration is valid.
+func SetRcloneConfigured() {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.rcloneConfigured = true
+}
+
+// SetSSHDRunning records whether the sshd process is running.
+func SetSSHDRunning(running bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.sshdRunning = running
+}
+
+// SyncStarted records that a sync cycle has started.
+func SyncStarted() {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.syncRunning = true
+	state.syncStartedAt = time.Now()
+}
+
+// SyncFinished records that a sync cycle has finished.
+func SyncFinished(success bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.syncRunning = false
+	if success && !state.initialSyncDone {
+		state.initialSyncDone = true
+		close(state.initialSync)
+	}
+}
+
+// InitialSync returns a channel that is closed once the first sync cycle has
+// succeeded.
+func InitialSync() <-chan struct{} {
+	return state.initialSync
+}
+
+// InitialSyncDone reports whether a sync cycle has succeeded at least once.
+func InitialSyncDone() bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.initialSyncDone
+}
+
+// checks are the named results of a probe
+type checks map[string]bool
+
+// respond writes the checks as JSON, with 200 if all of them pass or 503
+// otherwise.
+func respond(w http.ResponseWriter, c checks) {
+	status := http.StatusOK
+	for _, ok := range c {
+		if !ok {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ok":     status == http.StatusOK,
+		"checks": c,
+	})
+}
+
+// LivenessHandler serves /healthz, it fails when sshd is not running or a
+// sync cycle has been running for longer than maxSyncDuration.
+func LivenessHandler(maxSyncDuration time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		state.mu.Lock()
+		c := checks{
+			"sshd": state.sshdRunning,
+			"sync_loop": !state.syncRunning ||
+				time.Since(state.syncStartedAt) <= maxSyncDuration,
+		}
+		state.mu.Unlock()
+
+		respond(w, c)
+	})
+}
+
+// ReadinessHandler serves /readyz, it fails until the users are provisioned,
+// the rclone configuration is valid, sshd is running and the initial sync has
+// completed.
+func ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		state.mu.Lock()
+		c := checks{
+			"users":        state.usersProvisioned,
+			"rclone":       state.rcloneConfigured,
+			"sshd":         state.sshdRunning,
+			"initial_sync": state.initialSyncDone,
+		}
+		state.mu.Unlock()
+
+		respond(w, c)
+	})
+}
@@ -0,0 +1,58 @@
+package health
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func probe(h http.Handler) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	return rec.Code
+}
+
+func TestHandlers(t *testing.T) {
+	liveness := LivenessHandler(time.Hour)
+	readiness := ReadinessHandler()
+
+	// Test nothing is healthy nor ready before startup
+	assert.Equal(t, http.StatusServiceUnavailable, probe(liveness))
+	assert.Equal(t, http.StatusServiceUnavailable, probe(readiness))
+
+	// Test sshd running makes the process alive, but not ready yet
+	SetUsersProvisioned()
+	SetRcloneConfigured()
+	SetSSHDRunning(true)
+	assert.Equal(t, http.StatusOK, probe(liveness))
+	assert.Equal(t, http.StatusServiceUnavailable, probe(readiness))
+
+	// Test a failed initial sync keeps the process not ready
+	SyncStarted()
+	SyncFinished(false)
+	assert.Equal(t, http.StatusServiceUnavailable, probe(readiness))
+
+	// Test the first successful sync makes the process ready
+	select {
+	case <-InitialSync():
+		t.Fatal("initial sync channel closed before the first success")
+	default:
+	}
+	SyncStarted()
+	SyncFinished(true)
+	assert.Equal(t, http.StatusOK, probe(readiness))
+	assert.True(t, InitialSyncDone())
+	<-InitialSync()
+
+	// Test a sync cycle running for too long makes the process not alive
+	SyncStarted()
+	assert.Equal(t, http.StatusServiceUnavailable, probe(LivenessHandler(0)))
+	SyncFinished(true)
+
+	// Test sshd exiting makes the process not alive
+	SetSSHDRunning(false)
+	assert.Equal(t, http.StatusServiceUnavailable, probe(liveness))
+}
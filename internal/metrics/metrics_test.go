@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	SyncCycles.Inc(ResultSuccess)
+	SyncBytes.Add(DirectionUpload, 2048)
+	SyncDuration.Observe(12)
+	SSHDUp.Set(1)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	out := string(body)
+
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain; version=0.0.4")
+
+	// Test counters expose every known label value
+	assert.Contains(t, out, "# TYPE s3ftp_sync_cycles_total counter\n")
+	assert.Contains(t, out, `s3ftp_sync_cycles_total{result="success"} 1`+"\n")
+	assert.Contains(t, out, `s3ftp_sync_cycles_total{result="failure"} 0`+"\n")
+	assert.Contains(t, out, `s3ftp_sync_bytes_total{direction="upload"} 2048`+"\n")
+
+	// Test histogram buckets are cumulative
+	assert.Contains(t, out, `s3ftp_sync_duration_seconds_bucket{le="5"} 0`+"\n")
+	assert.Contains(t, out, `s3ftp_sync_duration_seconds_bucket{le="15"} 1`+"\n")
+	assert.Contains(t, out, `s3ftp_sync_duration_seconds_bucket{le="+Inf"} 1`+"\n")
+	assert.Contains(t, out, "s3ftp_sync_duration_seconds_sum 12\n")
+	assert.Contains(t, out, "s3ftp_sync_duration_seconds_count 1\n")
+
+	// Test gauges
+	assert.Contains(t, out, "# TYPE s3ftp_sshd_up gauge\ns3ftp_sshd_up 1\n")
+}
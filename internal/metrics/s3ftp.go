@@ -0,0 +1,121 @@
+package metrics
+
+// Sync result label values
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Sync abort reason label values
+const (
+	AbortMaxDelete   = "max_delete"
+	AbortCheckAccess = "check_access"
+)
+
+// Killed run reason label values
+const (
+	KillTimeout = "timeout"
+	KillStall   = "stall"
+)
+
+// Transfer direction label values
+const (
+	DirectionUpload   = "upload"
+	DirectionDownload = "download"
+)
+
+var (
+	// SyncCycles counts the sync cycles by result
+	SyncCycles = newCounter(
+		"s3ftp_sync_cycles_total",
+		"Sync cycles by result.",
+		"result", ResultSuccess, ResultFailure,
+	)
+
+	// SyncDuration observes how long each sync cycle takes
+	SyncDuration = newHistogram(
+		"s3ftp_sync_duration_seconds",
+		"Duration of the sync cycles in seconds.",
+		[]float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+	)
+
+	// SyncBytes counts the bytes transferred by direction
+	SyncBytes = newCounter(
+		"s3ftp_sync_bytes_total",
+		"Bytes transferred by direction.",
+		"direction", DirectionUpload, DirectionDownload,
+	)
+
+	// SyncFiles counts the files transferred by direction
+	SyncFiles = newCounter(
+		"s3ftp_sync_files_total",
+		"Files transferred by direction.",
+		"direction", DirectionUpload, DirectionDownload,
+	)
+
+	// SyncPushes counts the pushes of changed files by result
+	SyncPushes = newCounter(
+		"s3ftp_sync_pushes_total",
+		"Pushes of the files changed since the last sync by result.",
+		"result", ResultSuccess, ResultFailure,
+	)
+
+	// SyncAborts counts the runs aborted by a safety check by reason
+	SyncAborts = newCounter(
+		"s3ftp_sync_aborts_total",
+		"Sync runs aborted by a safety check by reason.",
+		"reason", AbortMaxDelete, AbortCheckAccess,
+	)
+
+	// SyncKills counts the rclone runs killed by the watchdog by reason
+	SyncKills = newCounter(
+		"s3ftp_sync_killed_total",
+		"rclone runs killed for taking too long or not making progress by reason.",
+		"reason", KillTimeout, KillStall,
+	)
+
+	// SyncDeletesBlocked counts the deletions blocked by the deletion limit
+	SyncDeletesBlocked = newCounter(
+		"s3ftp_sync_deletes_blocked_total",
+		"Deletions blocked by the deletion limit by sync mode.",
+		"mode", "sync", "bisync",
+	)
+
+	// SyncConflicts counts the files changed both locally and in S3 by user
+	SyncConflicts = newCounter(
+		"s3ftp_sync_conflicts_total",
+		"Files changed both locally and in S3 between two bisyncs by user.",
+		"user",
+	)
+
+	// SyncLastSuccess is the unix time of the last successful sync cycle
+	SyncLastSuccess = newGauge(
+		"s3ftp_sync_last_success_timestamp_seconds",
+		"Unix time of the last successful sync cycle.",
+	)
+
+	// SyncConsecutiveFailures is the number of failed cycles in a row
+	SyncConsecutiveFailures = newGauge(
+		"s3ftp_sync_consecutive_failures",
+		"Number of consecutive failed sync cycles.",
+	)
+
+	// Users is the number of configured SFTP users
+	Users = newGauge(
+		"s3ftp_sftp_users",
+		"Number of configured SFTP users.",
+	)
+
+	// SSHDRestarts counts the sshd restarts by cause
+	SSHDRestarts = newCounter(
+		"s3ftp_sshd_restarts_total",
+		"sshd restarts by cause.",
+		"cause", "exited", "invalid_config",
+	)
+
+	// SSHDUp is 1 while the sshd process is running
+	SSHDUp = newGauge(
+		"s3ftp_sshd_up",
+		"Whether the sshd process is running (1) or not (0).",
+	)
+)
@@ -0,0 +1,155 @@
+package rclone
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// bisyncFlags make bisync retry after less serious errors and recover from
+// interruptions on the next run, instead of requiring a --resync
+var bisyncFlags = []string{"--resilient", "--recover"}
+
+// hasBisyncState reports whether the bisync working directory holds the
+// listings of a previous successful run, so bisync can run without
+// --resync. rclone names them <session>.path1.lst and <session>.path2.lst.
+func hasBisyncState(workdir string) bool {
+	path1, _ := filepath.Glob(filepath.Join(workdir, "*.path1.lst"))
+	path2, _ := filepath.Glob(filepath.Join(workdir, "*.path2.lst"))
+	return len(path1) > 0 && len(path2) > 0
+}
+
+// restoreBisyncState restores the listings rclone renames to *.lst-err after
+// a critical error, so the next run still knows which files were deleted
+// since the last successful one. It returns false if there was none.
+func restoreBisyncState(workdir string) bool {
+	errListings, _ := filepath.Glob(filepath.Join(workdir, "*.lst-err"))
+	if len(errListings) == 0 {
+		return false
+	}
+
+	for _, path := range errListings {
+		if err := os.Rename(path, strings.TrimSuffix(path, "-err")); err != nil {
+			slog.Warn("error restoring bisync listing", "path", path, "error", err)
+			return false
+		}
+	}
+	return true
+}
+
+// listingPath returns the path, relative to the root, of a line of a bisync
+// listing. Each line ends with the quoted path, e.g.
+// `- 5 - - 2024-06-01T10:00:00.000000000+0000 "user/user/a.txt"`.
+func listingPath(line string) (string, bool) {
+	start := strings.Index(line, `"`)
+	if strings.HasPrefix(line, "#") || start < 0 {
+		return "", false
+	}
+	path, err := strconv.Unquote(line[start:])
+	return path, err == nil
+}
+
+// holdListed removes the entries of the given paths from the listings of the
+// last bisync, and returns the function that adds them back to the listings
+// once the run is done.
+//
+// An excluded file is missing from the new listings, so bisync would see a
+// file it knows as deleted, and on the next run as new on both sides, a
+// false conflict. Without its entries it is left alone, and once they are
+// back the next run compares it to its last synced version.
+func holdListed(workdir string, paths []string) (func(), error) {
+	held := map[string]bool{}
+	for _, path := range paths {
+		held[path] = true
+	}
+
+	listings, _ := filepath.Glob(filepath.Join(workdir, "*.path[12].lst"))
+	entries := map[string][]string{}
+	for _, listing := range listings {
+		kept, removed, err := splitListing(listing, held)
+		if err != nil {
+			return func() {}, err
+		}
+		if len(removed) == 0 {
+			continue
+		}
+		if err := writeFileAtomic(listing, []byte(strings.Join(kept, ""))); err != nil {
+			return func() {}, fmt.Errorf("error updating bisync listing: %w", err)
+		}
+		entries[listing] = removed
+	}
+
+	restore := func() {
+		for listing, removed := range entries {
+			// A failed run leaves the listings as *.lst-err, which are
+			// restored before the next run
+			for _, path := range []string{listing, listing + "-err"} {
+				kept, _, err := splitListing(path, held)
+				if err != nil {
+					continue
+				}
+				content := strings.Join(append(kept, removed...), "")
+				if err := writeFileAtomic(path, []byte(content)); err != nil {
+					slog.Warn("error restoring bisync listing entries", "path", path, "error", err)
+				}
+			}
+		}
+	}
+	return restore, nil
+}
+
+// splitListing reads a bisync listing and splits its lines, newlines
+// included, between the ones of the held paths and the others.
+func splitListing(listing string, held map[string]bool) ([]string, []string, error) {
+	content, err := os.ReadFile(listing)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kept, removed := []string{}, []string{}
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		if path, ok := listingPath(strings.TrimSuffix(line, "\n")); ok && held[path] {
+			removed = append(removed, line)
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return kept, removed, nil
+}
+
+// mustResync reports whether bisync failed with an error that requires a
+// --resync to recover.
+func mustResync(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "must run --resync")
+}
+
+// staleLocksOnce removes the stale lock files only on the first run
+var staleLocksOnce sync.Once
+
+// prepareBisyncWorkdir creates the bisync working directory. On the first
+// run of the process it also removes the lock files left behind when the
+// process was killed during a run, which would block every later run, so
+// the working directory must not be shared by several instances.
+func prepareBisyncWorkdir(workdir string) error {
+	if err := os.MkdirAll(workdir, 0700); err != nil {
+		return fmt.Errorf("error creating bisync workdir: %w", err)
+	}
+
+	staleLocksOnce.Do(func() {
+		locks, _ := filepath.Glob(filepath.Join(workdir, "*.lck"))
+		for _, path := range locks {
+			if err := os.Remove(path); err == nil {
+				slog.Warn("removed stale bisync lock file", "path", path)
+			}
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package rclone
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHasBisyncState(t *testing.T) {
+	workdir := t.TempDir()
+	session := filepath.Join(workdir, "s3_bucket..home")
+
+	// Test an empty workdir has no state
+	assert.False(t, hasBisyncState(workdir))
+
+	// Test both listings are required
+	require.NoError(t, os.WriteFile(session+".path1.lst", nil, 0600))
+	assert.False(t, hasBisyncState(workdir))
+	require.NoError(t, os.WriteFile(session+".path2.lst", nil, 0600))
+	assert.True(t, hasBisyncState(workdir))
+}
+
+func TestRestoreBisyncState(t *testing.T) {
+	workdir := t.TempDir()
+	session := filepath.Join(workdir, "s3_bucket..home")
+
+	// Test there is nothing to restore without error listings
+	assert.False(t, restoreBisyncState(workdir))
+
+	// Test the error listings are restored
+	require.NoError(t, os.WriteFile(session+".path1.lst-err", nil, 0600))
+	require.NoError(t, os.WriteFile(session+".path2.lst-err", nil, 0600))
+	assert.True(t, restoreBisyncState(workdir))
+	assert.True(t, hasBisyncState(workdir))
+	assert.FileExists(t, session+".path1.lst")
+	assert.NoFileExists(t, session+".path1.lst-err")
+}
+
+func TestMustResync(t *testing.T) {
+	assert.False(t, mustResync(nil))
+	assert.False(t, mustResync(errors.New("exit status 1: access denied")))
+	assert.True(t, mustResync(errors.New(
+		"exit status 2: Bisync aborted. Must run --resync to recover.",
+	)))
+}
+
+func TestPrepareBisyncWorkdir(t *testing.T) {
+	workdir := filepath.Join(t.TempDir(), "bisync")
+
+	// Test the workdir is created and the stale locks are removed
+	require.NoError(t, os.MkdirAll(workdir, 0700))
+	lock := filepath.Join(workdir, "s3_bucket..home.lck")
+	require.NoError(t, os.WriteFile(lock, nil, 0600))
+	require.NoError(t, prepareBisyncWorkdir(workdir))
+	assert.NoFileExists(t, lock)
+
+	// Test the locks are only removed on the first run
+	require.NoError(t, os.WriteFile(lock, nil, 0600))
+	require.NoError(t, prepareBisyncWorkdir(workdir))
+	assert.FileExists(t, lock)
+}
+
+func TestListingPath(t *testing.T) {
+	path, ok := listingPath(`- 5 - - 2024-06-01T10:00:00.000000000+0000 "user/user/with \"quotes\".txt"`)
+	assert.True(t, ok)
+	assert.Equal(t, `user/user/with "quotes".txt`, path)
+
+	_, ok = listingPath(`# bisync listing v1 from 2024-06-01 10:00:00.000000000 +0000 UTC`)
+	assert.False(t, ok)
+}
+
+func TestHoldListed(t *testing.T) {
+	workdir := t.TempDir()
+	session := filepath.Join(workdir, "s3_bucket..home")
+	header := "# bisync listing v1 from 2024-06-01 10:00:00.000000000 +0000 UTC\n"
+	a := `- 5 - - 2024-06-01T10:00:00.000000000+0000 "user1/user1/a.txt"` + "\n"
+	b := `- 9 - - 2024-06-01T10:00:00.000000000+0000 "user2/user2/b.txt"` + "\n"
+	for _, side := range []string{".path1.lst", ".path2.lst"} {
+		require.NoError(t, os.WriteFile(session+side, []byte(header+a+b), 0600))
+	}
+
+	// Test the entries of the files being overwritten are removed from the
+	// listings bisync reads
+	restore, err := holdListed(workdir, []string{"user1/user1/a.txt", "user1/user1/new.txt"})
+	require.NoError(t, err)
+	for _, side := range []string{".path1.lst", ".path2.lst"} {
+		content, err := os.ReadFile(session + side)
+		require.NoError(t, err)
+		assert.Equal(t, header+b, string(content))
+	}
+
+	// Test they are added back to the listings written by the run
+	c := `- 3 - - 2024-06-02T10:00:00.000000000+0000 "user2/user2/c.txt"` + "\n"
+	require.NoError(t, os.WriteFile(session+".path2.lst", []byte(header+b+c), 0600))
+	restore()
+	content, err := os.ReadFile(session + ".path2.lst")
+	require.NoError(t, err)
+	assert.Equal(t, header+b+c+a, string(content))
+	content, err = os.ReadFile(session + ".path1.lst")
+	require.NoError(t, err)
+	assert.Equal(t, header+b+a, string(content))
+}
@@ -0,0 +1,275 @@
+package rclone
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"s3ftp/internal/config"
+	"s3ftp/internal/health"
+	"strings"
+)
+
+// confPath is the path of the rclone configuration file
+const confPath = "/root/.config/rclone/rclone.conf"
+
+// option is a single key = value setting of an rclone remote
+type option struct {
+	key   string
+	value string
+}
+
+// remote is an rclone remote with its settings in the order they are written
+type remote struct {
+	name    string
+	options []option
+}
+
+// s3Remote returns the remote that points to the S3 bucket.
+func s3Remote(env *config.Env) remote {
+	r := remote{
+		name: "s3",
+		options: []option{
+			{"type", "s3"},
+			{"provider", "Other"},
+			{"region", *env.S3_REGION},
+			{"endpoint", *env.S3_ENDPOINT},
+		},
+	}
+
+	if roleEnabled(env) {
+		// The credentials the role is assumed with are in the profile
+		r.options = append(r.options, roleRemoteOptions()...)
+	} else if *env.S3_AUTH_MODE == config.S3AuthModeEnv {
+		// rclone resolves the credentials from AWS_* env vars, web identity
+		// tokens (EKS IRSA), ECS task roles or the EC2 instance profile
+		r.options = append(r.options, option{"env_auth", "true"})
+	} else {
+		r.options = append(r.options,
+			option{"access_key_id", *env.S3_ACCESS_KEY_ID},
+			option{"secret_access_key", *env.S3_SECRET_ACCESS_KEY},
+		)
+		if env.AWS_SESSION_TOKEN != nil && *env.AWS_SESSION_TOKEN != "" {
+			r.options = append(r.options, option{"session_token", *env.AWS_SESSION_TOKEN})
+		}
+	}
+
+	switch *env.S3_SSE {
+	case config.S3SSES3:
+		r.options = append(r.options, option{"server_side_encryption", "AES256"})
+	case config.S3SSEKMS:
+		r.options = append(r.options, option{"server_side_encryption", "aws:kms"})
+		if env.S3_SSE_KMS_KEY_ID != nil && *env.S3_SSE_KMS_KEY_ID != "" {
+			r.options = append(r.options, option{"sse_kms_key_id", *env.S3_SSE_KMS_KEY_ID})
+		}
+	case config.S3SSEC:
+		r.options = append(r.options,
+			option{"sse_customer_algorithm", "AES256"},
+			option{"sse_customer_key_base64", *env.S3_SSE_C_KEY},
+		)
+	}
+
+	return r
+}
+
+// cryptEnabled reports whether the objects are encrypted client-side.
+func cryptEnabled(env *config.Env) bool {
+	return env.S3_CRYPT_PASSWORD != nil && *env.S3_CRYPT_PASSWORD != ""
+}
+
+// cryptRemote returns the remote that encrypts the objects stored in the
+// bucket, so the storage vendor only sees ciphertext.
+func cryptRemote(env *config.Env) remote {
+	r := remote{
+		name: "crypt",
+		options: []option{
+			{"type", "crypt"},
+			{"remote", fmt.Sprintf("s3:%s", *env.S3_BUCKET)},
+			{"password", obscured[*env.S3_CRYPT_PASSWORD]},
+			{"filename_encryption", *env.S3_CRYPT_FILENAME_ENCRYPTION},
+			{"directory_name_encryption", fmt.Sprint(*env.S3_CRYPT_FILENAME_ENCRYPTION != "off")},
+		},
+	}
+
+	if env.S3_CRYPT_SALT != nil && *env.S3_CRYPT_SALT != "" {
+		r.options = append(r.options, option{"password2", obscured[*env.S3_CRYPT_SALT]})
+	}
+
+	return r
+}
+
+// remotes returns all the rclone remotes used by s3ftp.
+func remotes(env *config.Env) []remote {
+	rs := []remote{s3Remote(env)}
+	if cryptEnabled(env) {
+		rs = append(rs, cryptRemote(env))
+	}
+	return rs
+}
+
+// syncRemote returns the rclone path the local files are synced with, the
+// crypt remote when client-side encryption is enabled.
+func syncRemote(env *config.Env) string {
+	if cryptEnabled(env) {
+		return "crypt:"
+	}
+	return fmt.Sprintf("s3:%s/", *env.S3_BUCKET)
+}
+
+// obscured maps the secrets written to the remotes to their rclone obscured
+// form, it is filled by obscureSecrets.
+var obscured = map[string]string{}
+
+// obscureSecrets obscures the crypt secrets with rclone, as required by the
+// crypt remote. The secrets are passed through stdin so they never show up
+// in the process list.
+func obscureSecrets(env *config.Env) error {
+	if !cryptEnabled(env) {
+		return nil
+	}
+
+	secrets := []string{*env.S3_CRYPT_PASSWORD}
+	if env.S3_CRYPT_SALT != nil && *env.S3_CRYPT_SALT != "" {
+		secrets = append(secrets, *env.S3_CRYPT_SALT)
+	}
+
+	for _, secret := range secrets {
+		if _, ok := obscured[secret]; ok {
+			continue
+		}
+
+		cmd := exec.Command("rclone", "obscure", "-")
+		cmd.Stdin = strings.NewReader(secret)
+		out, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("error obscuring crypt secret: %w", err)
+		}
+		obscured[secret] = strings.TrimSpace(string(out))
+	}
+
+	return nil
+}
+
+// buildConf returns the content of the rclone configuration file.
+func buildConf(env *config.Env) string {
+	var b strings.Builder
+	for i, r := range remotes(env) {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "[%s]\n", r.name)
+		for _, o := range r.options {
+			fmt.Fprintf(&b, "%s = %s\n", o.key, o.value)
+		}
+	}
+	return b.String()
+}
+
+// confEnv returns the RCLONE_CONFIG_<REMOTE>_<KEY> env vars that define the
+// remotes without a configuration file.
+func confEnv(env *config.Env) []string {
+	vars := []string{}
+	for _, r := range remotes(env) {
+		prefix := "RCLONE_CONFIG_" + strings.ToUpper(r.name) + "_"
+		for _, o := range r.options {
+			vars = append(vars, prefix+strings.ToUpper(o.key)+"="+o.value)
+		}
+	}
+	return vars
+}
+
+// CreateConf creates the rclone configuration file.
+//
+// When S3_CONF_MODE is env no file is written, and any file left by a
+// previous run is deleted so no credentials remain on disk.
+func CreateConf(env *config.Env) error {
+	if err := obscureSecrets(env); err != nil {
+		return err
+	}
+
+	// The new files are renamed over the existing ones, so rclone never
+	// finds them missing or partial
+	if *env.S3_CONF_MODE != config.S3ConfModeEnv {
+		if err := writeFileAtomic(confPath, []byte(buildConf(env))); err != nil {
+			return err
+		}
+	} else if err := os.Remove(confPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if roleEnabled(env) {
+		return writeFileAtomic(awsConfigPath, []byte(roleConf(env, os.Getenv)))
+	}
+	if err := os.Remove(awsConfigPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// UseConf prepares the use of the configuration files written by the running
+// server, without touching them while its rclone processes read them. It
+// fails if a file the configuration needs is missing.
+func UseConf(env *config.Env) error {
+	if err := obscureSecrets(env); err != nil {
+		return err
+	}
+
+	required := []string{}
+	if *env.S3_CONF_MODE != config.S3ConfModeEnv {
+		required = append(required, confPath)
+	}
+	if roleEnabled(env) {
+		required = append(required, awsConfigPath)
+	}
+	for _, path := range required {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("rclone configuration not found, is the server running: %w", err)
+		}
+	}
+	return nil
+}
+
+// CheckRemote lists the root of the remote, so the configuration is only
+// reported as valid once rclone can reach the bucket with its credentials.
+// A successful sync cycle reports it as valid too.
+func CheckRemote(env *config.Env) error {
+	if _, err := output(env, "lsf", syncRemote(env), "--max-depth", "1"); err != nil {
+		return fmt.Errorf("error listing the remote: %w", err)
+	}
+
+	health.SetRcloneConfigured()
+	return nil
+}
+
+// writeFileAtomic writes the file with 0600 permissions through a temporary
+// file in the same directory, so the path never holds a partial file.
+func writeFileAtomic(path string, content []byte) error {
+	dir := filepath.Dir(path)
+
+	// Create the directory if it doesn't exist
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// os.CreateTemp creates the file with 0600 permissions
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,115 @@
+package rclone
+
+import (
+	"os"
+	"path/filepath"
+	"s3ftp/internal/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfEnv(t *testing.T) {
+	env := newTestEnv()
+	vars := confEnv(env)
+	assert.Contains(t, vars, "RCLONE_CONFIG_S3_TYPE=s3")
+	assert.Contains(t, vars, "RCLONE_CONFIG_S3_ACCESS_KEY_ID=key")
+	assert.Contains(t, vars, "RCLONE_CONFIG_S3_SECRET_ACCESS_KEY=secret")
+	assert.Contains(t, vars, "RCLONE_CONFIG_S3_ENDPOINT=s3.example.com")
+
+	// Test the remote is passed to the rclone process only in env mode
+	assert.NotContains(t, newCommand(env).Env, "RCLONE_CONFIG_S3_TYPE=s3")
+	mode := config.S3ConfModeEnv
+	env.S3_CONF_MODE = &mode
+	assert.Contains(t, newCommand(env).Env, "RCLONE_CONFIG_S3_TYPE=s3")
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rclone", "rclone.conf")
+
+	// Test the file is created with restricted permissions
+	err := writeFileAtomic(path, []byte("first"))
+	assert.NoError(t, err)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Test the file is replaced and no temporary files are left behind
+	err = writeFileAtomic(path, []byte("second"))
+	assert.NoError(t, err)
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(content))
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestBuildConfWithCrypt(t *testing.T) {
+	env := newTestEnv()
+	assert.Equal(t, "s3:bucket/", syncRemote(env))
+
+	password, salt, filenames := "password", "salt", "standard"
+	env.S3_CRYPT_PASSWORD = &password
+	env.S3_CRYPT_SALT = &salt
+	env.S3_CRYPT_FILENAME_ENCRYPTION = &filenames
+	obscured[password] = "obscured-password"
+	obscured[salt] = "obscured-salt"
+	defer delete(obscured, password)
+	defer delete(obscured, salt)
+
+	// Test the crypt remote wraps the bucket and only holds obscured secrets
+	conf := buildConf(env)
+	assert.Contains(t, conf, "[s3]\n")
+	assert.Contains(t, conf, "\n[crypt]\ntype = crypt\nremote = s3:bucket\n")
+	assert.Contains(t, conf, "password = obscured-password\n")
+	assert.Contains(t, conf, "password2 = obscured-salt\n")
+	assert.Contains(t, conf, "filename_encryption = standard\n")
+	assert.Contains(t, conf, "directory_name_encryption = true\n")
+	assert.NotContains(t, conf, "= password\n")
+
+	// Test syncs target the crypt remote
+	assert.Equal(t, "crypt:", syncRemote(env))
+}
+
+func TestBuildConfWithSSE(t *testing.T) {
+	env := newTestEnv()
+	assert.NotContains(t, buildConf(env), "server_side_encryption")
+
+	// Test SSE-S3
+	mode := config.S3SSES3
+	env.S3_SSE = &mode
+	assert.Contains(t, buildConf(env), "server_side_encryption = AES256\n")
+
+	// Test SSE-KMS with a specific key
+	mode, keyID := config.S3SSEKMS, "arn:aws:kms:us-east-1:123456789012:key/abc"
+	env.S3_SSE_KMS_KEY_ID = &keyID
+	conf := buildConf(env)
+	assert.Contains(t, conf, "server_side_encryption = aws:kms\n")
+	assert.Contains(t, conf, "sse_kms_key_id = "+keyID+"\n")
+
+	// Test SSE-C
+	mode, key := config.S3SSEC, "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	env.S3_SSE_KMS_KEY_ID = nil
+	env.S3_SSE_C_KEY = &key
+	conf = buildConf(env)
+	assert.NotContains(t, conf, "server_side_encryption")
+	assert.Contains(t, conf, "sse_customer_algorithm = AES256\n")
+	assert.Contains(t, conf, "sse_customer_key_base64 = "+key+"\n")
+}
+
+func TestCheckRemote(t *testing.T) {
+	env := newTestEnv()
+
+	// Test a listing rclone can make is valid
+	fakeRclone(t, "user1/")
+	assert.NoError(t, CheckRemote(env))
+
+	// Test a failed listing is reported with the rclone output
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho 'AccessDenied: Access Denied' >&2\nexit 1\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "rclone"), []byte(script), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	assert.ErrorContains(t, CheckRemote(env), "AccessDenied: Access Denied")
+}
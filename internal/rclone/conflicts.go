@@ -0,0 +1,181 @@
+package rclone
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"s3ftp/internal/config"
+	"s3ftp/internal/metrics"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// conflictResolve maps SYNC_CONFLICT_RESOLVE to the bisync --conflict-resolve
+// value, S3 is Path1 and the local directory Path2
+var conflictResolve = map[string]string{
+	config.SyncConflictKeepBoth: "none",
+	config.SyncConflictNewer:    "newer",
+	config.SyncConflictS3:       "path1",
+	config.SyncConflictLocal:    "path2",
+}
+
+// conflictFlags returns the bisync flags for the configured conflict
+// resolution. The losing version, or both with keep-both, is kept renamed
+// with a numbered SYNC_CONFLICT_SUFFIX, e.g. report.pdf.conflict1.
+func conflictFlags(env *config.Env) []string {
+	return []string{
+		"--conflict-resolve", conflictResolve[*env.SYNC_CONFLICT_RESOLVE],
+		"--conflict-loser", "num",
+		"--conflict-suffix", *env.SYNC_CONFLICT_SUFFIX,
+	}
+}
+
+// bisyncConflict matches the bisync message logged for every file changed on
+// both sides, e.g. "- WARNING  New or changed in both paths  - user/user/a.txt"
+var bisyncConflict = regexp.MustCompile(`New or changed in both paths\s+-\s+(.+)$`)
+
+// bisyncEqual matches the bisync message logged when a file changed on both
+// sides turns out to be identical, e.g.
+// "Files are equal! Skipping: user/user/a.txt"
+var bisyncEqual = regexp.MustCompile(`Files are equal! Skipping:?\s+(.+)$`)
+
+// conflictPath returns the path, relative to the local root, of the file
+// reported as a conflict in an rclone log message.
+func conflictPath(msg string) (string, bool) {
+	return matchPath(bisyncConflict, msg)
+}
+
+// equalPath returns the path, relative to the local root, of the file
+// reported as a conflict and then found identical on both sides, which is
+// not a conflict.
+func equalPath(msg string) (string, bool) {
+	return matchPath(bisyncEqual, msg)
+}
+
+// matchPath returns the path captured by re in an rclone log message.
+func matchPath(re *regexp.Regexp, msg string) (string, bool) {
+	m := re.FindStringSubmatch(strings.TrimSpace(msg))
+	if m == nil {
+		return "", false
+	}
+
+	// Paths with special characters are quoted
+	path := m[1]
+	if unquoted, err := strconv.Unquote(path); err == nil {
+		path = unquoted
+	}
+	return path, true
+}
+
+// conflictUser returns the SFTP user owning a path relative to the local
+// root, which is the first element of the path.
+func conflictUser(path string) string {
+	user, _, _ := strings.Cut(path, "/")
+	return user
+}
+
+// handleConflicts logs every conflict of a bisync run and, if
+// SYNC_CONFLICTS_DIR is set, moves the losing versions into that folder of
+// the user directory.
+func handleConflicts(env *config.Env, paths []string) {
+	for _, path := range paths {
+		user := conflictUser(path)
+		metrics.SyncConflicts.Inc(user)
+
+		attrs := []any{
+			"user", user,
+			"path", path,
+			"resolution", *env.SYNC_CONFLICT_RESOLVE,
+		}
+		if *env.SYNC_CONFLICTS_DIR != "" {
+			if moved := moveLosers(env, localRoot, path); len(moved) > 0 {
+				attrs = append(attrs, "losers", moved)
+			}
+		}
+		slog.Warn("sync conflict, file changed both locally and in S3", attrs...)
+	}
+}
+
+// moveLosers moves the losing versions of a conflicted file, relative to
+// root, into the SYNC_CONFLICTS_DIR folder of its user directory, keeping the
+// path of the file inside it. It returns the new paths relative to root. The
+// next bisync propagates the move to S3.
+func moveLosers(env *config.Env, root, path string) []string {
+	user := conflictUser(path)
+	userDir := filepath.Join(user, user)
+	rel, err := filepath.Rel(userDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil
+	}
+
+	losers := conflictLosers(filepath.Join(root, path), *env.SYNC_CONFLICT_SUFFIX)
+
+	moved := []string{}
+	for _, loser := range losers {
+		dir := filepath.Join(*env.SYNC_CONFLICTS_DIR, filepath.Dir(rel))
+		dst := filepath.Join(userDir, dir, filepath.Base(loser))
+
+		err := mkdirOwned(filepath.Join(root, userDir), dir)
+		if err == nil {
+			err = os.Rename(loser, filepath.Join(root, dst))
+		}
+		if err != nil {
+			slog.Warn("error moving conflict loser", "path", loser, "error", err)
+			continue
+		}
+		moved = append(moved, dst)
+	}
+
+	return moved
+}
+
+// conflictLosers returns the numbered versions bisync renamed a conflicting
+// file to, e.g. report.pdf.conflict1. The names are compared as strings, a
+// glob would treat the *?[ in file names as patterns.
+func conflictLosers(path, suffix string) []string {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil
+	}
+
+	prefix := filepath.Base(path) + "." + suffix
+	losers := []string{}
+	for _, entry := range entries {
+		num, found := strings.CutPrefix(entry.Name(), prefix)
+		if !found || num == "" || strings.Trim(num, "0123456789") != "" {
+			continue
+		}
+		losers = append(losers, filepath.Join(filepath.Dir(path), entry.Name()))
+	}
+	return losers
+}
+
+// mkdirOwned creates the dir path inside base, giving every directory the
+// owner of base so the SFTP user can access the files moved into it.
+func mkdirOwned(base, dir string) error {
+	info, err := os.Stat(base)
+	if err != nil {
+		return err
+	}
+	owner, _ := info.Sys().(*syscall.Stat_t)
+
+	path := base
+	for _, elem := range strings.Split(filepath.Clean(dir), string(filepath.Separator)) {
+		path = filepath.Join(path, elem)
+		if err := os.Mkdir(path, 0700); err != nil {
+			if os.IsExist(err) {
+				continue
+			}
+			return err
+		}
+		if owner != nil {
+			if err := os.Chown(path, int(owner.Uid), int(owner.Gid)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
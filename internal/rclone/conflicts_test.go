@@ -0,0 +1,96 @@
+package rclone
+
+import (
+	"os"
+	"path/filepath"
+	"s3ftp/internal/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConflictFlags(t *testing.T) {
+	env := newTestEnv()
+
+	// Test keep-both leaves the conflicts unresolved
+	assert.Equal(t, []string{
+		"--conflict-resolve", "none",
+		"--conflict-loser", "num",
+		"--conflict-suffix", "conflict",
+	}, conflictFlags(env))
+
+	// Test S3 and local map to the bisync paths
+	for resolve, want := range map[string]string{
+		config.SyncConflictNewer: "newer",
+		config.SyncConflictS3:    "path1",
+		config.SyncConflictLocal: "path2",
+	} {
+		env.SYNC_CONFLICT_RESOLVE = &resolve
+		assert.Equal(t, want, conflictFlags(env)[1])
+	}
+}
+
+func TestConflictPath(t *testing.T) {
+	path, ok := conflictPath(
+		"- WARNING           New or changed in both paths                - user1/user1/a.txt",
+	)
+	assert.True(t, ok)
+	assert.Equal(t, "user1/user1/a.txt", path)
+
+	// Test quoted paths are unquoted
+	path, ok = conflictPath(`- WARNING  New or changed in both paths  - "user1/user1/tab\there.txt"`)
+	assert.True(t, ok)
+	assert.Equal(t, "user1/user1/tab\there.txt", path)
+
+	_, ok = conflictPath("- Path1    File changed: size (larger) - user1/user1/a.txt")
+	assert.False(t, ok)
+}
+
+func TestEqualPath(t *testing.T) {
+	path, ok := equalPath("Files are equal! Skipping: user1/user1/a.txt")
+	assert.True(t, ok)
+	assert.Equal(t, "user1/user1/a.txt", path)
+
+	_, ok = equalPath("- WARNING  New or changed in both paths  - user1/user1/a.txt")
+	assert.False(t, ok)
+}
+
+func TestConflictUser(t *testing.T) {
+	assert.Equal(t, "user1", conflictUser("user1/user1/docs/a.txt"))
+	assert.Equal(t, "user1", conflictUser("user1"))
+}
+
+func TestMoveLosers(t *testing.T) {
+	root := t.TempDir()
+	docs := filepath.Join(root, "user1", "user1", "docs")
+	require.NoError(t, os.MkdirAll(docs, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(docs, "a.txt"), []byte("winner"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(docs, "a.txt.conflict1"), []byte("loser"), 0644))
+
+	env := newTestEnv()
+	dir := ".conflicts"
+	env.SYNC_CONFLICTS_DIR = &dir
+
+	// Test the loser is moved keeping its path inside the user directory
+	moved := moveLosers(env, root, "user1/user1/docs/a.txt")
+	assert.Equal(t, []string{"user1/user1/.conflicts/docs/a.txt.conflict1"}, moved)
+	assert.FileExists(t, filepath.Join(docs, "a.txt"))
+	assert.NoFileExists(t, filepath.Join(docs, "a.txt.conflict1"))
+
+	b, err := os.ReadFile(filepath.Join(root, moved[0]))
+	require.NoError(t, err)
+	assert.Equal(t, "loser", string(b))
+
+	// Test paths outside a user directory are left alone
+	assert.Nil(t, moveLosers(env, root, "user1/a.txt"))
+
+	// Test pattern characters in names are matched as is
+	for _, name := range []string{"[a].txt.conflict1", "a.txt.conflict2", "[a].txt.conflictx"} {
+		require.NoError(t, os.WriteFile(filepath.Join(docs, name), nil, 0644))
+	}
+	moved = moveLosers(env, root, "user1/user1/docs/[a].txt")
+	assert.Equal(t, []string{"user1/user1/.conflicts/docs/[a].txt.conflict1"}, moved)
+	assert.FileExists(t, filepath.Join(docs, "a.txt.conflict2"))
+	assert.FileExists(t, filepath.Join(docs, "[a].txt.conflictx"))
+}
@@ -0,0 +1,130 @@
+package rclone
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Directions of the changes planned by a dry run
+const (
+	planUpload      = "upload to S3"
+	planDownload    = "download from S3"
+	planDeleteS3    = "delete in S3"
+	planDeleteLocal = "delete locally"
+)
+
+// planDirections is the order the directions are printed in
+var planDirections = []string{planUpload, planDownload, planDeleteS3, planDeleteLocal}
+
+// plannedChange is a file rclone would copy or delete without --dry-run
+type plannedChange struct {
+	Direction string
+	Path      string
+}
+
+// dryRunSkipped matches the message rclone logs for every change skipped by
+// --dry-run, e.g. "Skipped copy as --dry-run is set (size 1.2Ki)"
+var dryRunSkipped = regexp.MustCompile(`^Skipped (.+?) as --dry-run is set`)
+
+// dryRunChange returns the change reported by an rclone log entry of a dry
+// run. A copy is logged on the source and a deletion on the deleted file, so
+// the object type tells the direction. Deletions into a backup dir, i.e. the
+// trash, are logged as moves.
+func dryRunChange(entry logEntry) (plannedChange, bool) {
+	m := dryRunSkipped.FindStringSubmatch(strings.TrimSpace(entry.Msg))
+	if m == nil || entry.Object == "" {
+		return plannedChange{}, false
+	}
+	local := strings.Contains(entry.ObjectType, "local.")
+
+	direction := ""
+	switch m[1] {
+	case "copy":
+		direction = planDownload
+		if local {
+			direction = planUpload
+		}
+	case "delete", "move into backup dir":
+		direction = planDeleteS3
+		if local {
+			direction = planDeleteLocal
+		}
+	default:
+		return plannedChange{}, false
+	}
+
+	return plannedChange{Direction: direction, Path: entry.Object}, true
+}
+
+// planByUser groups the planned changes by SFTP user and direction, sorting
+// the paths. rclone moves the file it replaces into the backup dir, which is
+// not a deletion, so it is dropped.
+func planByUser(changes []plannedChange) map[string]map[string][]string {
+	replaced := map[plannedChange]bool{}
+	for _, change := range changes {
+		switch change.Direction {
+		case planUpload:
+			replaced[plannedChange{Direction: planDeleteS3, Path: change.Path}] = true
+		case planDownload:
+			replaced[plannedChange{Direction: planDeleteLocal, Path: change.Path}] = true
+		}
+	}
+
+	plan := map[string]map[string][]string{}
+	for _, change := range changes {
+		if replaced[change] {
+			continue
+		}
+		user := conflictUser(change.Path)
+		if plan[user] == nil {
+			plan[user] = map[string][]string{}
+		}
+		paths := plan[user][change.Direction]
+		if !slices.Contains(paths, change.Path) {
+			plan[user][change.Direction] = append(paths, change.Path)
+		}
+	}
+
+	for _, directions := range plan {
+		for _, paths := range directions {
+			slices.Sort(paths)
+		}
+	}
+	return plan
+}
+
+// writePlan prints the changes of a dry run per user and direction.
+func writePlan(w io.Writer, changes []plannedChange) error {
+	plan := planByUser(changes)
+	if len(plan) == 0 {
+		_, err := fmt.Fprintln(w, "no changes")
+		return err
+	}
+
+	users := make([]string, 0, len(plan))
+	for user := range plan {
+		users = append(users, user)
+	}
+	slices.Sort(users)
+
+	b := strings.Builder{}
+	for _, user := range users {
+		fmt.Fprintf(&b, "%s:\n", user)
+		for _, direction := range planDirections {
+			paths := plan[user][direction]
+			if len(paths) == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, "  %s (%d):\n", direction, len(paths))
+			for _, path := range paths {
+				fmt.Fprintf(&b, "    %s\n", path)
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
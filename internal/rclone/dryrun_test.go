@@ -0,0 +1,85 @@
+package rclone
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRunChange(t *testing.T) {
+	entry := func(msg, object, objectType string) logEntry {
+		return logEntry{Msg: msg, Object: object, ObjectType: objectType}
+	}
+
+	// Test a copy is logged on the source
+	change, ok := dryRunChange(entry(
+		"Skipped copy as --dry-run is set (size 1.2Ki)", "user1/user1/a.txt", "*local.Object",
+	))
+	assert.True(t, ok)
+	assert.Equal(t, plannedChange{Direction: planUpload, Path: "user1/user1/a.txt"}, change)
+
+	change, ok = dryRunChange(entry(
+		"Skipped copy as --dry-run is set (size 10)", "user1/user1/b.txt", "*s3.Object",
+	))
+	assert.True(t, ok)
+	assert.Equal(t, planDownload, change.Direction)
+
+	// Test a deletion is logged on the deleted file, moves into the trash
+	// included
+	change, ok = dryRunChange(entry(
+		"Skipped delete as --dry-run is set (size 10)", "user1/user1/c.txt", "*local.Object",
+	))
+	assert.True(t, ok)
+	assert.Equal(t, planDeleteLocal, change.Direction)
+
+	change, ok = dryRunChange(entry(
+		"Skipped move into backup dir as --dry-run is set (size 10)", "user1/user1/d.txt", "*crypt.Object",
+	))
+	assert.True(t, ok)
+	assert.Equal(t, planDeleteS3, change.Direction)
+
+	// Test the other skipped changes and the other messages are ignored
+	_, ok = dryRunChange(entry(
+		"Skipped set modification time as --dry-run is set", "user1/user1/e.txt", "*local.Object",
+	))
+	assert.False(t, ok)
+	_, ok = dryRunChange(entry("Copied (new)", "user1/user1/f.txt", "*local.Object"))
+	assert.False(t, ok)
+}
+
+func TestWritePlan(t *testing.T) {
+	changes := []plannedChange{
+		{Direction: planDownload, Path: "user2/user2/z.txt"},
+		{Direction: planUpload, Path: "user1/user1/b.txt"},
+		{Direction: planUpload, Path: "user1/user1/a.txt"},
+		// The version replaced by an upload moved into the trash
+		{Direction: planDeleteS3, Path: "user1/user1/a.txt"},
+		{Direction: planDeleteS3, Path: "user1/user1/old.txt"},
+		{Direction: planDeleteLocal, Path: "user2/user2/gone.txt"},
+	}
+
+	// Test the changes are grouped by user and direction
+	out := strings.Builder{}
+	require.NoError(t, writePlan(&out, changes))
+	assert.Equal(t, strings.Join([]string{
+		"user1:",
+		"  upload to S3 (2):",
+		"    user1/user1/a.txt",
+		"    user1/user1/b.txt",
+		"  delete in S3 (1):",
+		"    user1/user1/old.txt",
+		"user2:",
+		"  download from S3 (1):",
+		"    user2/user2/z.txt",
+		"  delete locally (1):",
+		"    user2/user2/gone.txt",
+		"",
+	}, "\n"), out.String())
+
+	// Test an empty plan
+	out.Reset()
+	require.NoError(t, writePlan(&out, nil))
+	assert.Equal(t, "no changes\n", out.String())
+}
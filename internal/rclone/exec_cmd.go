@@ -0,0 +1,166 @@
+package rclone
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"s3ftp/internal/config"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// statsFlags make rclone log in JSON, every transfer included, and report
+// the transfer stats, so its output can be turned into structured logs and a
+// per-run report
+var statsFlags = []string{
+	"--use-json-log",
+	"--verbose",
+	"--stats", "1m",
+	"--stats-log-level", "NOTICE",
+}
+
+// globalFlags returns the flags that must be passed to every rclone invocation.
+func globalFlags(env *config.Env) []string {
+	flags := []string{}
+
+	if env.S3_CA_BUNDLE != nil && *env.S3_CA_BUNDLE != "" {
+		flags = append(flags, "--ca-cert", *env.S3_CA_BUNDLE)
+	}
+	if env.S3_CLIENT_CERT != nil && *env.S3_CLIENT_CERT != "" {
+		flags = append(flags, "--client-cert", *env.S3_CLIENT_CERT)
+		flags = append(flags, "--client-key", *env.S3_CLIENT_KEY)
+	}
+	if env.S3_INSECURE_SKIP_VERIFY != nil && *env.S3_INSECURE_SKIP_VERIFY {
+		flags = append(flags, "--no-check-certificate")
+	}
+
+	return flags
+}
+
+// newCommand returns an rclone command with the given arguments followed by
+// the global flags. The proxy and, when S3_CONF_MODE is env, the remote
+// definitions are passed only to the child process env.
+func newCommand(env *config.Env, args ...string) *exec.Cmd {
+	args = append(args, globalFlags(env)...)
+	cmd := exec.Command("rclone", args...)
+
+	vars := append(proxyEnv(env), roleEnv(env)...)
+	if *env.S3_CONF_MODE == config.S3ConfModeEnv {
+		vars = append(vars, confEnv(env)...)
+	}
+	if len(vars) > 0 {
+		cmd.Env = append(os.Environ(), vars...)
+	}
+
+	return cmd
+}
+
+// run runs rclone with the given arguments, streaming its output into the
+// logs, and returns a report of what was done. rclone runs in its own process
+// group, which is killed if the run times out or stalls.
+//
+// When the rclone daemon is started, the commands it supports run in it as a
+// job instead.
+func run(env *config.Env, args ...string) (report, error) {
+	if rcd.enabled.Load() {
+		if method, params, ok := rcCall(args); ok {
+			return rcd.run(env, method, params)
+		}
+	}
+
+	args = append(args, statsFlags...)
+	cmd := newCommand(env, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return report{}, err
+	}
+	cmd.Stdout = cmd.Stderr
+
+	dog, err := newWatchdog(env)
+	if err != nil {
+		return report{}, err
+	}
+	// A dry run deletes nothing, it reports every planned change
+	if slices.Contains(args, "--dry-run") {
+		dog.maxDeletes = 0
+	}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return report{}, fmt.Errorf("error starting rclone: %w", err)
+	}
+	done := make(chan struct{})
+	terminate, kill := signalGroup(cmd.Process.Pid)
+	go dog.watch(done, terminate, kill)
+
+	rep, lastError := consumeLogs(env, stderr, dog)
+	err = cmd.Wait()
+	close(done)
+	rep.Duration = time.Since(start)
+
+	if blocked := dog.deletesBlocked(); blocked > 0 {
+		rep.DeletesBlocked += blocked
+		return rep, fmt.Errorf("bisync stopped, %d deletions planned", blocked)
+	}
+	if reason := dog.killed(); reason != "" {
+		return rep, fmt.Errorf("%w: %s", errRunKilled, reason)
+	}
+	if err != nil {
+		if lastError == "" {
+			lastError = rep.LastError
+		}
+		if lastError != "" {
+			return rep, fmt.Errorf("%w: %s", err, lastError)
+		}
+		return rep, err
+	}
+
+	return rep, nil
+}
+
+// output runs a short rclone command, e.g. a listing, and returns its
+// standard output, with the standard error, redacted, in the returned
+// error. These
+// commands report no progress, so the watchdog stops them after
+// SYNC_TIMEOUT or, if it is 0, after SYNC_STALL_TIMEOUT.
+func output(env *config.Env, args ...string) ([]byte, error) {
+	dog, err := newWatchdog(env)
+	if err != nil {
+		return nil, err
+	}
+	if dog.timeout == 0 {
+		dog.timeout = dog.stall
+	}
+	dog.stall = 0
+
+	cmd := newCommand(env, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting rclone: %w", err)
+	}
+	done := make(chan struct{})
+	terminate, kill := signalGroup(cmd.Process.Pid)
+	go dog.watch(done, terminate, kill)
+	err = cmd.Wait()
+	close(done)
+
+	if reason := dog.killed(); reason != "" {
+		return nil, fmt.Errorf("%w: %s", errRunKilled, reason)
+	}
+	if err != nil {
+		if msg := redactProxy(env, strings.TrimSpace(stderr.String())); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
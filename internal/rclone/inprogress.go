@@ -0,0 +1,216 @@
+package rclone
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"s3ftp/internal/config"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openForWrite returns the regular files under root that any process has
+// open for writing, e.g. the sftp-server of an upload in progress.
+func openForWrite(root string) map[string]bool {
+	files := map[string]bool{}
+
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/[0-9]*")
+	for _, fd := range fds {
+		path, err := os.Readlink(fd)
+		if err != nil || !isUnder(root, path) {
+			continue
+		}
+
+		// The fdinfo flags are in octal, the two lowest bits are the
+		// access mode
+		fdinfo := strings.Replace(fd, "/fd/", "/fdinfo/", 1)
+		flags, ok := readFdFlags(fdinfo)
+		if !ok || flags&(os.O_WRONLY|os.O_RDWR) == 0 {
+			continue
+		}
+
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			files[path] = true
+		}
+	}
+
+	return files
+}
+
+// readFdFlags reads the flags line of a /proc/<pid>/fdinfo/<fd> file.
+func readFdFlags(path string) (int, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), "flags:")
+		if !found {
+			continue
+		}
+		flags, err := strconv.ParseInt(strings.TrimSpace(value), 8, 64)
+		if err != nil {
+			return 0, false
+		}
+		return int(flags), true
+	}
+
+	return 0, false
+}
+
+// isUnder reports whether path is inside the root directory.
+func isUnder(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != "." && !strings.HasPrefix(rel, "..")
+}
+
+// fileState is the size and modification time of a file
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// changingFiles returns the files under root whose size or modification
+// time changes within settle. Only the files modified in the last settle
+// are checked, so it only waits when something was written recently.
+func changingFiles(root string, settle time.Duration) map[string]bool {
+	files := map[string]bool{}
+	if settle <= 0 {
+		return files
+	}
+
+	recent := map[string]fileState{}
+	since := time.Now().Add(-settle)
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().Before(since) {
+			return nil
+		}
+		recent[path] = fileState{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	if len(recent) == 0 {
+		return files
+	}
+
+	time.Sleep(settle)
+	for path, before := range recent {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.Size() != before.size || !info.ModTime().Equal(before.modTime) {
+			files[path] = true
+		}
+	}
+
+	return files
+}
+
+// inProgressFiles returns the files under root that are still being
+// written, relative to root and sorted: the ones open for writing and the
+// ones whose size or modification time changes within settle.
+func inProgressFiles(root string, settle time.Duration) []string {
+	files := openForWrite(root)
+	for path := range changingFiles(root, settle) {
+		files[path] = true
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			continue
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+	}
+	slices.Sort(paths)
+
+	return paths
+}
+
+// escapeFilter escapes the rclone filter pattern characters of a path and
+// anchors it to the root, so it only matches that file.
+func escapeFilter(path string) string {
+	var b strings.Builder
+	b.WriteString("/")
+	for _, r := range path {
+		if strings.ContainsRune(`\*?[]{}`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// localInProgress returns the files under the local directory root still
+// being uploaded, relative to it.
+func localInProgress(env *config.Env, root string) ([]string, error) {
+	settle, err := time.ParseDuration(*env.SYNC_SETTLE_TIME)
+	if err != nil {
+		return nil, err
+	}
+	return inProgressFiles(root, settle), nil
+}
+
+// excludeInProgress returns the flags that exclude the files still being
+// uploaded from an rclone run of the local directory root, so a truncated
+// file is never pushed to S3 or, in sync mode, deleted. The files are picked
+// up by the next cycle.
+//
+// The returned function removes the exclude list and must be called once
+// rclone has finished.
+func excludeInProgress(env *config.Env, root string) ([]string, func(), error) {
+	paths, err := localInProgress(env, root)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	return excludeList(paths)
+}
+
+// excludeList returns the flags that exclude the given paths, relative to
+// the root of the run, through a temporary exclude list.
+//
+// The returned function removes the exclude list and must be called once
+// rclone has finished.
+func excludeList(paths []string) ([]string, func(), error) {
+	if len(paths) == 0 {
+		return nil, func() {}, nil
+	}
+	slog.Info("skipping files still being uploaded", "files", len(paths))
+
+	f, err := os.CreateTemp("", "s3ftp-exclude-from-*")
+	if err != nil {
+		return nil, func() {}, fmt.Errorf("error creating exclude list: %w", err)
+	}
+	cleanup := func() { _ = os.Remove(f.Name()) }
+
+	w := bufio.NewWriter(f)
+	for _, path := range paths {
+		if strings.ContainsAny(path, "\r\n") {
+			continue
+		}
+		_, _ = w.WriteString(escapeFilter(path) + "\n")
+	}
+	err = w.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return nil, func() {}, fmt.Errorf("error writing exclude list: %w", err)
+	}
+
+	return []string{"--exclude-from", f.Name()}, cleanup, nil
+}
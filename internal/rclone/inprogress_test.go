@@ -0,0 +1,144 @@
+package rclone
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowWriter writes to path every interval until ctx is done, keeping the
+// file open like an SFTP upload in progress.
+func slowWriter(t *testing.T, ctx context.Context, path string, interval time.Duration) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+
+	go func() {
+		defer f.Close()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, _ = f.WriteString("chunk")
+			}
+		}
+	}()
+}
+
+func TestOpenForWrite(t *testing.T) {
+	root := t.TempDir()
+
+	// Test a file open for writing is detected
+	uploading := filepath.Join(root, "uploading.bin")
+	f, err := os.Create(uploading)
+	require.NoError(t, err)
+	_, err = f.WriteString("partial")
+	require.NoError(t, err)
+
+	// Test a file only open for reading is not
+	readOnly := filepath.Join(root, "read.bin")
+	require.NoError(t, os.WriteFile(readOnly, []byte("data"), 0644))
+	r, err := os.Open(readOnly)
+	require.NoError(t, err)
+	defer r.Close()
+
+	assert.Equal(t, map[string]bool{uploading: true}, openForWrite(root))
+
+	// Test the file is no longer detected once the upload finishes
+	require.NoError(t, f.Close())
+	assert.Empty(t, openForWrite(root))
+}
+
+func TestChangingFiles(t *testing.T) {
+	root := t.TempDir()
+
+	// A file written a while ago
+	old := filepath.Join(root, "old.bin")
+	require.NoError(t, os.WriteFile(old, []byte("data"), 0644))
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(old, past, past))
+
+	// A file written recently that is complete
+	done := filepath.Join(root, "done.bin")
+	require.NoError(t, os.WriteFile(done, []byte("data"), 0644))
+
+	// A file still growing
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	growing := filepath.Join(root, "growing.bin")
+	slowWriter(t, ctx, growing, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	// Test only the growing file is detected
+	assert.Equal(t, map[string]bool{growing: true}, changingFiles(root, 100*time.Millisecond))
+
+	// Test the check is disabled with no settle time
+	assert.Empty(t, changingFiles(root, 0))
+}
+
+func TestInProgressFiles(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "user", "user"), 0755))
+
+	// Test a slow writer that pauses longer than the settle time is still
+	// detected through its open file
+	ctx, cancel := context.WithCancel(context.Background())
+	slowWriter(t, ctx, filepath.Join(root, "user", "user", "slow.bin"), time.Hour)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "user", "user", "done.bin"), nil, 0644))
+
+	assert.Equal(t, []string{"user/user/slow.bin"}, inProgressFiles(root, 0))
+
+	// Test it is picked up once the writer is done
+	cancel()
+	assert.Eventually(t, func() bool {
+		return len(inProgressFiles(root, 0)) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestEscapeFilter(t *testing.T) {
+	assert.Equal(t, "/user/user/file.txt", escapeFilter("user/user/file.txt"))
+	assert.Equal(
+		t,
+		`/user/user/\[draft\] \*final\?\{1\}\\.txt`,
+		escapeFilter(`user/user/[draft] *final?{1}\.txt`),
+	)
+}
+
+func TestExcludeInProgress(t *testing.T) {
+	env := newTestEnv()
+	settle := "0s"
+	env.SYNC_SETTLE_TIME = &settle
+	root := t.TempDir()
+	userDir := filepath.Join(root, "user", "user")
+	require.NoError(t, os.MkdirAll(userDir, 0755))
+
+	// Test nothing is excluded when no upload is in progress
+	flags, cleanup, err := excludeInProgress(env, userDir)
+	require.NoError(t, err)
+	assert.Empty(t, flags)
+	cleanup()
+
+	// Test the paths are relative to the root of the run, e.g. a user dir
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	slowWriter(t, ctx, filepath.Join(userDir, "[draft].bin"), time.Hour)
+
+	flags, cleanup, err = excludeInProgress(env, userDir)
+	require.NoError(t, err)
+	require.Len(t, flags, 2)
+	assert.Equal(t, "--exclude-from", flags[0])
+	list, err := os.ReadFile(flags[1])
+	require.NoError(t, err)
+	assert.Equal(t, "/\\[draft\\].bin\n", string(list))
+
+	// Test the exclude list is removed once the run is done
+	cleanup()
+	assert.NoFileExists(t, flags[1])
+}
@@ -0,0 +1,183 @@
+package rclone
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"s3ftp/internal/config"
+	"slices"
+	"strings"
+	"time"
+)
+
+// stats are the transfer statistics rclone reports with --use-json-log
+type stats struct {
+	Bytes     int64   `json:"bytes"`
+	Checks    int64   `json:"checks"`
+	Deletes   int64   `json:"deletes"`
+	Errors    int64   `json:"errors"`
+	Renames   int64   `json:"renames"`
+	Transfers int64   `json:"transfers"`
+	Listed    int64   `json:"listed"`
+	Elapsed   float64 `json:"elapsedTime"`
+	LastError string  `json:"lastError"`
+}
+
+// logEntry is a line of rclone output with --use-json-log
+type logEntry struct {
+	Level      string `json:"level"`
+	Msg        string `json:"msg"`
+	Object     string `json:"object"`
+	ObjectType string `json:"objectType"`
+	Source     string `json:"source"`
+	Stats      *stats `json:"stats"`
+}
+
+// transfers counts the files and bytes transferred in a single direction
+type transfers struct {
+	Files int64
+	Bytes int64
+}
+
+// report summarizes a single rclone run
+type report struct {
+	stats
+	Uploaded       transfers
+	Downloaded     transfers
+	DeletesBlocked int64
+	Conflicts      []string
+	Planned        []plannedChange
+	Duration       time.Duration
+}
+
+// addTransfer records a file copied by rclone. The object is the destination,
+// so a local object means it was downloaded from S3. The size is read from
+// the local file, which is either the source or the destination.
+func (r *report) addTransfer(entry logEntry) {
+	size := int64(0)
+	if info, err := os.Stat(filepath.Join(localRoot, entry.Object)); err == nil {
+		size = info.Size()
+	}
+
+	t := &r.Uploaded
+	if strings.Contains(entry.ObjectType, "local.") {
+		t = &r.Downloaded
+	}
+	t.Files++
+	t.Bytes += size
+}
+
+// logAttrs returns the report as slog attributes.
+func (r report) logAttrs() []any {
+	return []any{
+		"transferred", r.Transfers,
+		"deleted", r.Deletes,
+		"deletes_blocked", r.DeletesBlocked,
+		"conflicts", len(r.Conflicts),
+		"renamed", r.Renames,
+		"checked", r.Checks,
+		"bytes", r.Bytes,
+		"errors", r.Errors,
+		"uploaded_files", r.Uploaded.Files,
+		"uploaded_bytes", r.Uploaded.Bytes,
+		"downloaded_files", r.Downloaded.Files,
+		"downloaded_bytes", r.Downloaded.Bytes,
+		"duration", r.Duration.Round(time.Millisecond).String(),
+	}
+}
+
+// slogLevel maps an rclone log level to a slog level.
+func slogLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "info", "notice":
+		return slog.LevelInfo
+	case "warning":
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
+
+// isTransfer reports whether the log entry is a file copied by rclone.
+func isTransfer(entry logEntry) bool {
+	return entry.Object != "" && strings.HasPrefix(entry.Msg, "Copied")
+}
+
+// consumeLogs streams the rclone output into slog and returns a report with
+// the last stats and the transfers logged, and the last error message logged
+// by rclone. The watchdog, if not nil, observes the stats and the deletions
+// planned by bisync.
+func consumeLogs(env *config.Env, r io.Reader, dog *watchdog) (report, string) {
+	rep := report{}
+	lastError := ""
+	// Files changed on both sides are only conflicts if they differ
+	equal := map[string]bool{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := redactProxy(env, scanner.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		entry := logEntry{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			// Not every line is JSON, e.g. panics or flag errors
+			slog.Info(line, "source", "rclone")
+			continue
+		}
+
+		if entry.Stats != nil {
+			rep.stats = *entry.Stats
+			if dog != nil {
+				dog.observe(rep.stats)
+			}
+			slog.Debug("rclone stats", report{stats: rep.stats}.logAttrs()...)
+			continue
+		}
+
+		rep.DeletesBlocked += blockedDeletes(entry.Msg)
+		if _, ok := deletedPath(entry.Msg); ok && dog != nil {
+			dog.observeDelete()
+		}
+		if path, ok := conflictPath(entry.Msg); ok {
+			rep.Conflicts = append(rep.Conflicts, path)
+		}
+		if path, ok := equalPath(entry.Msg); ok {
+			equal[path] = true
+		}
+
+		level := slogLevel(entry.Level)
+		if isTransfer(entry) {
+			rep.addTransfer(entry)
+			// Every file is logged, keep them out of the default level
+			level = slog.LevelDebug
+		}
+		if change, ok := dryRunChange(entry); ok {
+			rep.Planned = append(rep.Planned, change)
+			level = slog.LevelDebug
+		}
+		if level >= slog.LevelError {
+			lastError = strings.TrimSpace(entry.Msg)
+		}
+
+		attrs := []any{"source", "rclone"}
+		if entry.Object != "" {
+			attrs = append(attrs, "object", entry.Object)
+		}
+		slog.Log(context.Background(), level, strings.TrimSpace(entry.Msg), attrs...)
+	}
+
+	rep.Conflicts = slices.DeleteFunc(rep.Conflicts, func(path string) bool {
+		return equal[path]
+	})
+
+	return rep, lastError
+}
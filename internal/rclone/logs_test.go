@@ -0,0 +1,58 @@
+package rclone
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumeLogs(t *testing.T) {
+	env := newTestEnv()
+	output := strings.Join([]string{
+		`{"level":"error","msg":"Got fatal error on delete: --max-delete threshold reached","source":"sync/sync.go:400"}`,
+		`{"level":"error","msg":"Got fatal error on delete: --max-delete threshold reached","source":"sync/sync.go:400"}`,
+		`{"level":"info","msg":"Copied (new)","object":"user1/a.txt","objectType":"*local.Object","source":"operations/copy.go:255","time":"2024-06-01T10:00:00Z"}`,
+		`{"level":"info","msg":"Copied (replaced existing)","object":"user2/c.txt","objectType":"*s3.Object","source":"operations/copy.go:255"}`,
+		`{"level":"error","msg":"Failed to copy: access denied","object":"user1/b.txt","source":"operations/copy.go:100"}`,
+		`{"level":"info","msg":"\nTransferred: 10 B / 10 B\n","source":"accounting/stats.go:482","stats":{"bytes":5,"checks":1,"deletes":0,"errors":0,"transfers":1,"elapsedTime":0.5}}`,
+		`{"level":"notice","msg":"\nTransferred: 10 B / 10 B\n","source":"accounting/stats.go:482","stats":{"bytes":10,"checks":3,"deletes":2,"errors":1,"transfers":2,"elapsedTime":1.2,"lastError":"access denied"}}`,
+		`{"level":"info","msg":"Deleted","object":"user1/old.txt","objectType":"*local.Object","source":"operations/operations.go:100"}`,
+		`{"level":"notice","msg":"- WARNING           New or changed in both paths                - user1/user1/a.txt","source":"bisync/deltas.go:300"}`,
+		`2024/06/01 10:00:01 Failed to sync: not a json line`,
+		``,
+	}, "\n")
+
+	// Test the last stats and the last error are returned
+	st, lastError := consumeLogs(env, strings.NewReader(output), nil)
+	assert.Equal(t, int64(1), st.Downloaded.Files)
+	assert.Equal(t, int64(1), st.Uploaded.Files)
+	assert.Equal(t, int64(10), st.Bytes)
+	assert.Equal(t, int64(3), st.Checks)
+	assert.Equal(t, int64(2), st.Deletes)
+	assert.Equal(t, int64(1), st.Errors)
+	assert.Equal(t, int64(2), st.Transfers)
+	assert.Equal(t, int64(2), st.DeletesBlocked)
+	assert.Equal(t, []string{"user1/user1/a.txt"}, st.Conflicts)
+	assert.Equal(t, "access denied", st.LastError)
+	assert.Equal(t, "Failed to copy: access denied", lastError)
+
+	// Test files changed on both sides but identical are not conflicts
+	output = strings.Join([]string{
+		`{"level":"notice","msg":"- WARNING           New or changed in both paths                - user1/user1/a.txt","source":"bisync/deltas.go:300"}`,
+		`{"level":"notice","msg":"- WARNING           New or changed in both paths                - user1/user1/b.txt","source":"bisync/deltas.go:300"}`,
+		`{"level":"info","msg":"Files are equal! Skipping: user1/user1/a.txt","source":"bisync/deltas.go:350"}`,
+	}, "\n")
+	st, _ = consumeLogs(env, strings.NewReader(output), nil)
+	assert.Equal(t, []string{"user1/user1/b.txt"}, st.Conflicts)
+}
+
+func TestSlogLevel(t *testing.T) {
+	assert.Equal(t, slog.LevelDebug, slogLevel("debug"))
+	assert.Equal(t, slog.LevelInfo, slogLevel("info"))
+	assert.Equal(t, slog.LevelInfo, slogLevel("notice"))
+	assert.Equal(t, slog.LevelWarn, slogLevel("warning"))
+	assert.Equal(t, slog.LevelError, slogLevel("error"))
+	assert.Equal(t, slog.LevelError, slogLevel("critical"))
+}
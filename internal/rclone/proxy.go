@@ -0,0 +1,93 @@
+package rclone
+
+import (
+	"net"
+	"net/url"
+	"s3ftp/internal/config"
+	"strings"
+)
+
+// proxyEnv returns the env vars that route the traffic of the rclone child
+// processes through the configured proxy. Both cases are set because tools
+// differ on which one they honor.
+func proxyEnv(env *config.Env) []string {
+	if env.S3_HTTP_PROXY == nil || *env.S3_HTTP_PROXY == "" {
+		return nil
+	}
+
+	vars := []string{
+		"HTTP_PROXY=" + *env.S3_HTTP_PROXY,
+		"HTTPS_PROXY=" + *env.S3_HTTP_PROXY,
+		"http_proxy=" + *env.S3_HTTP_PROXY,
+		"https_proxy=" + *env.S3_HTTP_PROXY,
+	}
+	if env.S3_NO_PROXY != nil && *env.S3_NO_PROXY != "" {
+		vars = append(vars,
+			"NO_PROXY="+*env.S3_NO_PROXY,
+			"no_proxy="+*env.S3_NO_PROXY,
+		)
+	}
+
+	return vars
+}
+
+// proxyForHost returns the proxy to use to reach the given host, or nil if
+// the host must be reached directly.
+func proxyForHost(env *config.Env, host string) (*url.URL, error) {
+	if env.S3_HTTP_PROXY == nil || *env.S3_HTTP_PROXY == "" {
+		return nil, nil
+	}
+	if env.S3_NO_PROXY != nil && matchNoProxy(*env.S3_NO_PROXY, host) {
+		return nil, nil
+	}
+	return url.Parse(*env.S3_HTTP_PROXY)
+}
+
+// matchNoProxy reports whether the host is excluded from proxying by the
+// comma separated NO_PROXY list. Entries match the host itself and its
+// subdomains, "*" matches everything.
+func matchNoProxy(noProxy, host string) bool {
+	host = strings.ToLower(host)
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.TrimPrefix(entry, ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactProxy replaces the password in any occurrence of the proxy URL in s,
+// as configured or percent-encoded, so it is safe to be written to the logs.
+// Only the URL userinfo is redacted, the password alone may be any word.
+func redactProxy(env *config.Env, s string) string {
+	if env.S3_HTTP_PROXY == nil || *env.S3_HTTP_PROXY == "" {
+		return s
+	}
+
+	u, err := url.Parse(*env.S3_HTTP_PROXY)
+	if err != nil {
+		return strings.ReplaceAll(s, *env.S3_HTTP_PROXY, "<redacted proxy>")
+	}
+
+	s = strings.ReplaceAll(s, *env.S3_HTTP_PROXY, u.Redacted())
+	s = strings.ReplaceAll(s, u.String(), u.Redacted())
+
+	// The userinfo alone, e.g. in a Proxy-Authorization error
+	if password, ok := u.User.Password(); ok && password != "" {
+		redacted := url.UserPassword(u.User.Username(), "xxxxx").String() + "@"
+		s = strings.ReplaceAll(s, u.User.String()+"@", redacted)
+		s = strings.ReplaceAll(s, u.User.Username()+":"+password+"@", redacted)
+	}
+	return s
+}
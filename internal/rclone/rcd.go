@@ -0,0 +1,467 @@
+package rclone
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"s3ftp/internal/config"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// rcdUser is the user of the rclone remote control API, its password is
+	// generated on every start
+	rcdUser = "s3ftp"
+	// rcdStartTimeout is how long rclone rcd has to start serving its API
+	rcdStartTimeout = 30 * time.Second
+	// rcdPollInterval is how often the status and stats of a job are polled
+	rcdPollInterval = time.Second
+)
+
+// rcd is the rclone rcd process driving the runs when SYNC_RCD is set
+var rcd = &rcDaemon{}
+
+// rcDaemon is a long-lived rclone rcd process. Every sync, bisync and copy
+// runs in it as an async job, so it reuses the remotes and their caches
+// instead of starting from scratch.
+type rcDaemon struct {
+	enabled atomic.Bool
+
+	// mu serializes the jobs, as their logs are told apart by time, and
+	// guards the process
+	mu     sync.Mutex
+	addr   string
+	pass   string
+	cmd    *exec.Cmd
+	exited chan struct{}
+	client *http.Client
+
+	// sinkMu guards sink, where the logs of the running job are written
+	sinkMu sync.Mutex
+	sink   io.Writer
+}
+
+// jobStatus is the status of an async job returned by job/status
+type jobStatus struct {
+	Finished bool    `json:"finished"`
+	Success  bool    `json:"success"`
+	Error    string  `json:"error"`
+	Duration float64 `json:"duration"`
+}
+
+// rcBisyncFlags maps the bisync flags to the sync/bisync parameters, value
+// being true for the flags that take one
+var rcBisyncFlags = map[string]struct {
+	param string
+	value bool
+}{
+	"--workdir":          {"workdir", true},
+	"--backup-dir1":      {"backupdir1", true},
+	"--conflict-resolve": {"conflictResolve", true},
+	"--conflict-loser":   {"conflictLoser", true},
+	"--conflict-suffix":  {"conflictSuffix", true},
+	"--resync":           {"resync", false},
+	"--resilient":        {"resilient", false},
+	"--recover":          {"recover", false},
+	"--dry-run":          {"dryRun", false},
+}
+
+// rcCall translates the arguments of an rclone sync, copy or bisync command
+// into the remote control method and its parameters. It returns false when
+// an argument has no equivalent, the command then runs in its own process.
+//
+// Filters and global flags go into the _filter and _config parameters, which
+// apply to that call only.
+func rcCall(args []string) (string, map[string]any, bool) {
+	if len(args) < 3 {
+		return "", nil, false
+	}
+
+	method := ""
+	params := map[string]any{}
+	switch args[0] {
+	case "sync", "copy":
+		method = "sync/" + args[0]
+		params["srcFs"], params["dstFs"] = args[1], args[2]
+	case "bisync":
+		method = "sync/bisync"
+		params["path1"], params["path2"] = args[1], args[2]
+	default:
+		return "", nil, false
+	}
+	bisync := args[0] == "bisync"
+
+	filter := map[string]any{}
+	conf := map[string]any{}
+	appendFilter := func(key, value string) {
+		list, _ := filter[key].([]string)
+		filter[key] = append(list, value)
+	}
+
+	flags := args[3:]
+	for i := 0; i < len(flags); i++ {
+		flag := flags[i]
+		value := ""
+		if i+1 < len(flags) {
+			value = flags[i+1]
+		}
+
+		if f, ok := rcBisyncFlags[flag]; ok && bisync {
+			if f.value {
+				params[f.param] = value
+				i++
+			} else {
+				params[f.param] = true
+			}
+			continue
+		}
+
+		switch flag {
+		case "--exclude":
+			appendFilter("ExcludeRule", value)
+		case "--exclude-from":
+			appendFilter("ExcludeFrom", value)
+		case "--files-from-raw":
+			appendFilter("FilesFromRaw", value)
+		case "--backup-dir":
+			conf["BackupDir"] = value
+		case "--max-delete":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return "", nil, false
+			}
+			// bisync takes a percentage, sync a number of files
+			if bisync {
+				params["maxDelete"] = n
+			} else {
+				conf["MaxDelete"] = n
+			}
+		case "--dry-run":
+			conf["DryRun"] = true
+			continue
+		case "--no-traverse":
+			conf["NoTraverse"] = true
+			continue
+		default:
+			return "", nil, false
+		}
+		i++
+	}
+
+	if len(filter) > 0 {
+		params["_filter"] = filter
+	}
+	if len(conf) > 0 {
+		params["_config"] = conf
+	}
+	return method, params, true
+}
+
+// StartDaemon starts rclone rcd, which then runs every sync, bisync and copy
+// as a job. If it exits, it is started again by the next run.
+func StartDaemon(env *config.Env) error {
+	rcd.mu.Lock()
+	defer rcd.mu.Unlock()
+
+	rcd.enabled.Store(true)
+	rcd.addr = *env.SYNC_RCD_ADDR
+	rcd.client = &http.Client{Timeout: 30 * time.Second}
+	return rcd.start(env)
+}
+
+// StopDaemon stops rclone rcd, if it was started, killing it if it is still
+// running after killGrace.
+func StopDaemon() {
+	rcd.mu.Lock()
+	defer rcd.mu.Unlock()
+
+	rcd.enabled.Store(false)
+	if rcd.cmd == nil {
+		return
+	}
+
+	terminate, kill := signalGroup(rcd.cmd.Process.Pid)
+	terminate()
+	select {
+	case <-rcd.exited:
+	case <-time.After(killGrace):
+		kill()
+		<-rcd.exited
+	}
+	rcd.cmd = nil
+	slog.Info("rclone daemon stopped")
+}
+
+// start starts the rclone rcd process, unless it is already running, and
+// waits for its API to be served.
+func (d *rcDaemon) start(env *config.Env) error {
+	if d.cmd != nil {
+		select {
+		case <-d.exited:
+			slog.Warn("rclone daemon exited, starting it again")
+		default:
+			return nil
+		}
+	}
+
+	pass := make([]byte, 16)
+	if _, err := rand.Read(pass); err != nil {
+		return err
+	}
+	d.pass = hex.EncodeToString(pass)
+
+	cmd := newCommand(env, "rcd", "--rc-addr", d.addr, "--use-json-log", "--verbose")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// The credentials are passed in the env so they don't show in ps
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, "RCLONE_RC_USER="+rcdUser, "RCLONE_RC_PASS="+d.pass)
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = cmd.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting rclone daemon: %w", err)
+	}
+
+	d.cmd = cmd
+	d.exited = make(chan struct{})
+	go d.pumpLogs(env, cmd, stderr, d.exited)
+
+	deadline := time.Now().Add(rcdStartTimeout)
+	for {
+		err := d.call("rc/noop", map[string]any{}, nil)
+		if err == nil {
+			break
+		}
+		select {
+		case <-d.exited:
+			return errors.New("error starting rclone daemon: rclone rcd exited")
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			terminate, _ := signalGroup(cmd.Process.Pid)
+			terminate()
+			return fmt.Errorf("error starting rclone daemon: %w", err)
+		}
+	}
+
+	slog.Info("rclone daemon started", "addr", d.addr)
+	return nil
+}
+
+// pumpLogs writes every line logged by rclone rcd to the sink of the running
+// job, or straight into slog between jobs. It closes exited once the process
+// has exited.
+func (d *rcDaemon) pumpLogs(env *config.Env, cmd *exec.Cmd, stderr io.Reader, exited chan struct{}) {
+	scanner := bufio.NewScanner(stderr)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text() + "\n"
+
+		d.sinkMu.Lock()
+		if d.sink != nil {
+			_, _ = io.WriteString(d.sink, line)
+		} else {
+			consumeLogs(env, strings.NewReader(line), nil)
+		}
+		d.sinkMu.Unlock()
+	}
+
+	err := cmd.Wait()
+	if d.enabled.Load() {
+		slog.Warn("rclone daemon exited", "error", err)
+	}
+	close(exited)
+}
+
+// setSink sets where the logs of the running job are written.
+func (d *rcDaemon) setSink(w io.Writer) {
+	d.sinkMu.Lock()
+	defer d.sinkMu.Unlock()
+	d.sink = w
+}
+
+// call calls a method of the remote control API, decoding its result into
+// out if it is not nil.
+func (d *rcDaemon) call(method string, in map[string]any, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+d.addr+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(rcdUser, d.pass)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		rcErr := struct {
+			Error string `json:"error"`
+		}{}
+		_ = json.NewDecoder(resp.Body).Decode(&rcErr)
+		return fmt.Errorf("rclone %s failed with status %d: %s", method, resp.StatusCode, rcErr.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// run runs a method as an async job, starting rclone rcd again if it exited,
+// and returns a report of what was done.
+func (d *rcDaemon) run(env *config.Env, method string, params map[string]any) (report, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.start(env); err != nil {
+		return report{}, err
+	}
+	return d.runJob(env, method, params)
+}
+
+// runJob runs a method as an async job and waits for it to finish, feeding
+// its stats to the watchdog, which stops the job when it times out or
+// stalls. The logs of the job are consumed like those of a process.
+func (d *rcDaemon) runJob(env *config.Env, method string, params map[string]any) (report, error) {
+	dog, err := newWatchdog(env)
+	if err != nil {
+		return report{}, err
+	}
+	// A dry run deletes nothing, it reports every planned change
+	if params["dryRun"] == true {
+		dog.maxDeletes = 0
+	}
+
+	type logsResult struct {
+		rep       report
+		lastError string
+	}
+	pr, pw := io.Pipe()
+	logs := make(chan logsResult, 1)
+	go func() {
+		rep, lastError := consumeLogs(env, pr, dog)
+		_, _ = io.Copy(io.Discard, pr)
+		logs <- logsResult{rep, lastError}
+	}()
+	d.setSink(pw)
+
+	start := time.Now()
+	status, last, err := d.startAndWait(method, params, dog)
+	d.setSink(nil)
+	_ = pw.Close()
+	res := <-logs
+
+	rep := res.rep
+	rep.stats = last
+	rep.Duration = time.Since(start)
+
+	if blocked := dog.deletesBlocked(); blocked > 0 {
+		rep.DeletesBlocked += blocked
+		return rep, fmt.Errorf("bisync stopped, %d deletions planned", blocked)
+	}
+	if reason := dog.killed(); reason != "" {
+		return rep, fmt.Errorf("%w: %s", errRunKilled, reason)
+	}
+	// The errors reported by the daemon may include the proxy URL
+	if err != nil {
+		return rep, errors.New(redactProxy(env, err.Error()))
+	}
+	if !status.Success {
+		lastError := res.lastError
+		if lastError == "" {
+			lastError = redactProxy(env, rep.LastError)
+		}
+		statusError := redactProxy(env, status.Error)
+		if lastError != "" && lastError != statusError {
+			return rep, fmt.Errorf("%s: %s", statusError, lastError)
+		}
+		return rep, errors.New(statusError)
+	}
+
+	return rep, nil
+}
+
+// startAndWait starts the async job and polls its status until it finishes.
+// It returns the final status and the last stats of the job.
+func (d *rcDaemon) startAndWait(
+	method string, params map[string]any, dog *watchdog,
+) (jobStatus, stats, error) {
+	params["_async"] = true
+	job := struct {
+		ID int64 `json:"jobid"`
+	}{}
+	if err := d.call(method, params, &job); err != nil {
+		return jobStatus{}, stats{}, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	terminate := func() {
+		if err := d.call("job/stop", map[string]any{"jobid": job.ID}, nil); err != nil {
+			slog.Warn("error stopping rclone job", "jobid", job.ID, "error", err)
+		}
+	}
+	kill := func() {
+		if d.cmd != nil {
+			_, kill := signalGroup(d.cmd.Process.Pid)
+			kill()
+		}
+	}
+	go dog.watch(done, terminate, kill)
+
+	ticker := time.NewTicker(rcdPollInterval)
+	defer ticker.Stop()
+	last := stats{}
+	group := fmt.Sprintf("job/%d", job.ID)
+	for {
+		select {
+		case <-d.exited:
+			return jobStatus{}, last, errors.New("rclone daemon exited during the run")
+		case <-ticker.C:
+		}
+
+		// The status comes first, so the stats of a finished job are final
+		status := jobStatus{}
+		if err := d.call("job/status", map[string]any{"jobid": job.ID}, &status); err != nil {
+			slog.Warn("error getting rclone job status", "jobid", job.ID, "error", err)
+			continue
+		}
+
+		st := stats{}
+		if err := d.call("core/stats", map[string]any{"group": group}, &st); err == nil {
+			last = st
+			dog.observe(st)
+			attrs := append([]any{"jobid", job.ID}, report{stats: st}.logAttrs()...)
+			slog.Debug("rclone job progress", attrs...)
+		}
+
+		if status.Finished {
+			return status, last, nil
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package rclone
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRcCall(t *testing.T) {
+	// Test the bisync flags become parameters and the filters go into _filter
+	method, params, ok := rcCall([]string{
+		"bisync", "s3:bucket/", "/home",
+		"--workdir", "/var/lib/s3ftp/bisync",
+		"--resilient", "--recover",
+		"--conflict-resolve", "none",
+		"--max-delete", "50",
+		"--exclude", "/.trash/**",
+		"--exclude-from", "/tmp/exclude",
+		"--dry-run",
+	})
+	assert.True(t, ok)
+	assert.Equal(t, "sync/bisync", method)
+	assert.Equal(t, map[string]any{
+		"path1":           "s3:bucket/",
+		"path2":           "/home",
+		"workdir":         "/var/lib/s3ftp/bisync",
+		"resilient":       true,
+		"recover":         true,
+		"conflictResolve": "none",
+		"maxDelete":       50,
+		"dryRun":          true,
+		"_filter": map[string]any{
+			"ExcludeRule": []string{"/.trash/**"},
+			"ExcludeFrom": []string{"/tmp/exclude"},
+		},
+	}, params)
+
+	// Test the sync flags go into _config
+	method, params, ok = rcCall([]string{
+		"copy", "/home", "s3:bucket/",
+		"--files-from-raw", "/tmp/files",
+		"--no-traverse",
+		"--backup-dir", "s3:bucket/.trash/2024-06-01T100000Z",
+	})
+	assert.True(t, ok)
+	assert.Equal(t, "sync/copy", method)
+	assert.Equal(t, map[string]any{
+		"srcFs": "/home",
+		"dstFs": "s3:bucket/",
+		"_filter": map[string]any{
+			"FilesFromRaw": []string{"/tmp/files"},
+		},
+		"_config": map[string]any{
+			"NoTraverse": true,
+			"BackupDir":  "s3:bucket/.trash/2024-06-01T100000Z",
+		},
+	}, params)
+
+	_, params, ok = rcCall([]string{"sync", "s3:bucket/", "/home", "--max-delete", "10"})
+	assert.True(t, ok)
+	assert.Equal(t, map[string]any{"MaxDelete": 10}, params["_config"])
+
+	// Test the commands with flags that have no equivalent run in a process
+	_, _, ok = rcCall([]string{"sync", "s3:bucket/", "/snapshots", "--s3-version-at", "2024-06-01T10:00:00Z"})
+	assert.False(t, ok)
+	_, _, ok = rcCall([]string{"lsf", "s3:bucket/"})
+	assert.False(t, ok)
+}
+
+// fakeRcd serves the remote control methods used by the jobs. The job
+// finishes on the second status poll with the given error.
+func fakeRcd(t *testing.T, jobError string) (*rcDaemon, *atomic.Bool) {
+	stopped := &atomic.Bool{}
+	polls := atomic.Int32{}
+
+	mux := http.NewServeMux()
+	reply := func(w http.ResponseWriter, v any) {
+		require.NoError(t, json.NewEncoder(w).Encode(v))
+	}
+	mux.HandleFunc("/sync/sync", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if user != rcdUser || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		params := map[string]any{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&params))
+		assert.Equal(t, true, params["_async"])
+		reply(w, map[string]any{"jobid": 7})
+	})
+	mux.HandleFunc("/job/status", func(w http.ResponseWriter, _ *http.Request) {
+		finished := polls.Add(1) >= 2
+		reply(w, jobStatus{Finished: finished, Success: jobError == "", Error: jobError})
+	})
+	mux.HandleFunc("/core/stats", func(w http.ResponseWriter, r *http.Request) {
+		params := map[string]any{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&params))
+		assert.Equal(t, "job/7", params["group"])
+		reply(w, stats{Bytes: int64(100 * polls.Load()), Transfers: 2, Checks: 5})
+	})
+	mux.HandleFunc("/job/stop", func(w http.ResponseWriter, _ *http.Request) {
+		stopped.Store(true)
+		reply(w, map[string]any{})
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return &rcDaemon{
+		addr:   strings.TrimPrefix(srv.URL, "http://"),
+		pass:   "secret",
+		client: srv.Client(),
+		exited: make(chan struct{}),
+	}, stopped
+}
+
+func TestRunJob(t *testing.T) {
+	env := newTestEnv()
+
+	// Test the job is polled until it finishes and its last stats reported
+	d, stopped := fakeRcd(t, "")
+	rep, err := d.runJob(env, "sync/sync", map[string]any{"srcFs": "s3:bucket/", "dstFs": "/home"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(200), rep.Bytes)
+	assert.Equal(t, int64(2), rep.Transfers)
+	assert.False(t, stopped.Load())
+
+	// Test a failed job returns its error
+	d, _ = fakeRcd(t, "directory not found")
+	_, err = d.runJob(env, "sync/sync", map[string]any{})
+	assert.EqualError(t, err, "directory not found")
+
+	// Test an rc error is returned
+	d, _ = fakeRcd(t, "")
+	d.pass = "wrong"
+	_, err = d.runJob(env, "sync/sync", map[string]any{})
+	assert.ErrorContains(t, err, "status 401")
+}
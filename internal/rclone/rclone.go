@@ -1,114 +1,373 @@
 package rclone
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"os"
-	"os/exec"
+	"s3ftp/internal/backoff"
 	"s3ftp/internal/config"
+	"s3ftp/internal/health"
+	"s3ftp/internal/metrics"
 	"time"
 )
 
-const confTemplate = `[s3]
-type = s3
-provider = Other
-access_key_id = %s
-secret_access_key = %s
-region = %s
-endpoint = %s`
+// localRoot is the local directory synced with S3, holding every user home
+const localRoot = "/home"
 
-// CreateConf creates the rclone configuration file.
-func CreateConf(env *config.Env) error {
-	path := "/root/.config/rclone/rclone.conf"
+// bisync runs the rclone bidirectional sync command once. A dry run only
+// logs the changes and leaves the conflicting files alone.
+func bisync(env *config.Env, shouldResync, dryRun bool) (report, error) {
+	args := []string{"bisync", syncRemote(env), localRoot}
+	args = append(args, "--workdir", *env.SYNC_BISYNC_WORKDIR)
+	args = append(args, bisyncFlags...)
+	args = append(args, conflictFlags(env)...)
+	args = append(args, trashExcludeFlags(env)...)
+	args = append(args, trashBackupFlags(env, "--backup-dir1")...)
+	if shouldResync {
+		args = append(args, "--resync")
+	}
+	if dryRun {
+		args = append(args, "--dry-run")
+	}
 
-	// Delete the file if it exists
-	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-		return err
+	if err := checkAccess(env); err != nil {
+		return report{}, err
 	}
+	args = append(args, maxDeleteFlags(env, countFiles(localRoot))...)
 
-	// Create the directory if it doesn't exist
-	if err := os.MkdirAll("/root/.config/rclone", 0755); err != nil {
-		return err
+	inProgress, err := localInProgress(env, localRoot)
+	if err != nil {
+		return report{}, err
 	}
+	exclude, cleanup, err := excludeList(inProgress)
+	if err != nil {
+		return report{}, err
+	}
+	defer cleanup()
+	args = append(args, exclude...)
 
-	// Create the file
-	if _, err := os.Create(path); err != nil {
-		return err
+	// The files being overwritten keep their entries of the last run, a
+	// resync starts from scratch
+	if !shouldResync && !dryRun && len(inProgress) > 0 {
+		restore, err := holdListed(*env.SYNC_BISYNC_WORKDIR, inProgress)
+		if err != nil {
+			return report{}, err
+		}
+		defer restore()
 	}
 
-	// Write the file
-	fileContent := fmt.Sprintf(
-		confTemplate,
-		*env.S3_ACCESS_KEY_ID,
-		*env.S3_SECRET_ACCESS_KEY,
-		*env.S3_REGION,
-		*env.S3_ENDPOINT,
-	)
-	if err := os.WriteFile(path, []byte(fileContent), 0644); err != nil {
-		return err
+	rep, err := run(env, args...)
+	if !dryRun {
+		handleConflicts(env, rep.Conflicts)
+	}
+	if err := checkDeletes(env, rep, err); err != nil {
+		return rep, fmt.Errorf("error: %w", err)
 	}
 
-	return nil
+	return rep, nil
 }
 
 // runBisync runs the rclone bidirectional sync command.
-func runBisync(env *config.Env, shouldResync bool) error {
-	cmd := fmt.Sprintf("rclone bisync s3:%s/ /home", *env.S3_BUCKET)
-	if shouldResync {
-		cmd += " --resync"
+//
+// When bisync fails with an error that requires a --resync, it first retries
+// with the listings of the last successful run, so the files deleted since
+// then stay deleted, and only resyncs if that fails too. A dry run never
+// touches the listings, so it returns the error.
+func runBisync(env *config.Env, shouldResync, dryRun bool) (report, error) {
+	workdir := *env.SYNC_BISYNC_WORKDIR
+	if err := prepareBisyncWorkdir(workdir); err != nil {
+		return report{}, err
 	}
 
-	_, err := exec.Command("sh", "-c", cmd).Output()
-	if err != nil {
-		return fmt.Errorf("error: %w", err)
+	rep, err := bisync(env, shouldResync, dryRun)
+	if shouldResync || dryRun || !mustResync(err) {
+		return rep, err
 	}
 
-	return nil
+	if restoreBisyncState(workdir) {
+		slog.Warn("bisync requires a resync, retrying with the last listings", "error", err)
+		rep, err = bisync(env, false, false)
+		if !mustResync(err) {
+			return rep, err
+		}
+	}
+
+	slog.Warn(
+		"bisync state could not be recovered, running with --resync, "+
+			"files deleted since the last sync may be restored",
+		"error", err,
+	)
+	return bisync(env, true, false)
 }
 
 // runSync runs the rclone sync command.
-func runSync(env *config.Env, _ bool) error {
-	cmd := fmt.Sprintf("rclone sync s3:%s/ /home", *env.S3_BUCKET)
+func runSync(env *config.Env, _, dryRun bool) (report, error) {
+	args := []string{"sync", syncRemote(env), localRoot}
+	args = append(args, trashExcludeFlags(env)...)
+	if dryRun {
+		args = append(args, "--dry-run")
+	}
+
+	if err := checkAccess(env); err != nil {
+		return report{}, err
+	}
+	args = append(args, maxDeleteFlags(env, countFiles(localRoot))...)
 
-	_, err := exec.Command("sh", "-c", cmd).Output()
+	exclude, cleanup, err := excludeInProgress(env, localRoot)
 	if err != nil {
-		return fmt.Errorf("error: %w", err)
+		return report{}, err
 	}
+	defer cleanup()
+	args = append(args, exclude...)
 
-	return nil
+	rep, err := run(env, args...)
+	if err := checkDeletes(env, rep, err); err != nil {
+		return rep, fmt.Errorf("error: %w", err)
+	}
+
+	return rep, nil
 }
 
-// RunLoop runs the rclone sync or bisync loop.
-func RunLoop(env *config.Env) error {
+// syncFunc runs a single sync cycle
+type syncFunc func(env *config.Env, shouldResync bool) (report, error)
+
+// syncFuncFor returns the sync cycle of the configured SYNC_MODE, which only
+// logs the changes it would make if dryRun is true.
+func syncFuncFor(env *config.Env, dryRun bool) syncFunc {
+	if *env.SYNC_MODE == "bisync" {
+		return func(env *config.Env, shouldResync bool) (report, error) {
+			return runBisync(env, shouldResync, dryRun)
+		}
+	}
+	return func(env *config.Env, shouldResync bool) (report, error) {
+		return runSync(env, shouldResync, dryRun)
+	}
+}
+
+// runWithRetries runs fn, retrying it with exponential backoff up to
+// SYNC_RETRIES times. It returns the report of the last attempt, and its
+// error if every attempt failed. Safety aborts and runs killed by the
+// watchdog are not retried.
+// Retries stop early, returning the last error, when ctx is done.
+func runWithRetries(
+	ctx context.Context, env *config.Env, fn syncFunc, shouldResync bool,
+) (report, error) {
+	base, err := time.ParseDuration(*env.SYNC_RETRY_BACKOFF)
+	if err != nil {
+		return report{}, err
+	}
+	max, err := time.ParseDuration(*env.SYNC_RETRY_MAX_BACKOFF)
+	if err != nil {
+		return report{}, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		rep, err := fn(env, shouldResync)
+		retryable := !errors.Is(err, errSafetyAbort) && !errors.Is(err, errRunKilled)
+		if err == nil || attempt >= *env.SYNC_RETRIES || !retryable {
+			return rep, err
+		}
+
+		wait := backoff.Delay(attempt+1, base, max)
+		slog.Warn(
+			"S3 sync failed, retrying",
+			"error", err,
+			"attempt", attempt+1,
+			"retries", *env.SYNC_RETRIES,
+			"retry_in", wait.String(),
+		)
+		if !backoff.Sleep(ctx, wait) {
+			return rep, err
+		}
+	}
+}
+
+// recordTransfers records the files and bytes transferred by a run in the
+// metrics.
+func recordTransfers(rep report) {
+	metrics.SyncFiles.Add(metrics.DirectionUpload, float64(rep.Uploaded.Files))
+	metrics.SyncBytes.Add(metrics.DirectionUpload, float64(rep.Uploaded.Bytes))
+	metrics.SyncFiles.Add(metrics.DirectionDownload, float64(rep.Downloaded.Files))
+	metrics.SyncBytes.Add(metrics.DirectionDownload, float64(rep.Downloaded.Bytes))
+}
+
+// recordMetrics records the result of a sync cycle in the metrics.
+func recordMetrics(rep report, err error) {
+	metrics.SyncDuration.Observe(rep.Duration.Seconds())
+	recordTransfers(rep)
+
+	if err != nil {
+		metrics.SyncCycles.Inc(metrics.ResultFailure)
+		return
+	}
+	metrics.SyncCycles.Inc(metrics.ResultSuccess)
+	metrics.SyncLastSuccess.Set(float64(time.Now().Unix()))
+}
+
+// RunLoop runs the rclone sync or bisync loop on the configured schedule.
+//
+// A cycle that still fails after its retries puts the loop in a degraded
+// state but keeps it running, so sshd keeps serving the local files. It only
+// returns an error after SYNC_MAX_FAILED_CYCLES consecutive failed cycles
+// (never if it is 0). Cycles stopped by a safety check don't count.
+//
+// A cycle also starts right away when requested with SyncNow.
+//
+// When ctx is done the loop returns nil once the in-flight cycle, if any, has
+// finished, so rclone is never killed halfway through a transfer.
+func RunLoop(ctx context.Context, env *config.Env) error {
 	slog.Info("starting rclone loop...")
 
-	dur, err := time.ParseDuration(*env.SYNC_INTERVAL)
+	sched, err := newSchedule(env)
 	if err != nil {
 		return err
 	}
 
-	fn := runSync
-	if *env.SYNC_MODE == "bisync" {
-		fn = runBisync
+	// Not even the first sync runs inside a blackout window
+	if end, blocked := sched.BlackoutEnd(time.Now()); blocked {
+		slog.Info("in a sync blackout window, waiting for it to end", "until", formatNext(end))
+		if !sleepUntil(ctx, end) {
+			slog.Info("rclone loop stopped")
+			return nil
+		}
 	}
 
+	fn := syncFuncFor(env, false)
+
 	executions := 0
+	failedCycles := 0
+	// req is the request that started the current cycle, if any
+	var req *syncRequest
+	var ok bool
 	for {
-		shouldResync := executions == 0
-		if err := fn(env, shouldResync); err != nil {
-			return err
+		// Resync only when there is no state of a previous bisync, e.g. on
+		// the first run or when the workdir is not persisted
+		shouldResync := *env.SYNC_MODE == "bisync" && !hasBisyncState(*env.SYNC_BISYNC_WORKDIR)
+		syncMu.Lock()
+		health.SyncStarted()
+		rep, err := runWithRetries(ctx, env, fn, shouldResync)
+		if err == nil {
+			// The startup check may have failed while S3 was unreachable
+			health.SetRcloneConfigured()
+		}
+		health.SyncFinished(err == nil)
+		syncMu.Unlock()
+		recordMetrics(rep, err)
+		if req != nil {
+			req.done <- err
+			req = nil
+		}
+		if err != nil && errors.Is(err, errSafetyAbort) {
+			// The alert is already raised and nothing was deleted, the local
+			// files keep being served, so it never counts as a failed cycle
+			next := sched.Next(time.Now())
+			slog.Error(
+				"S3 sync aborted by a safety check, serving the local files",
+				"error", err,
+				"next_execution", formatNext(next),
+			)
+			if req, ok = waitNext(ctx, next); !ok {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			failedCycles++
+			metrics.SyncConsecutiveFailures.Set(float64(failedCycles))
+			if *env.SYNC_MAX_FAILED_CYCLES > 0 && failedCycles >= *env.SYNC_MAX_FAILED_CYCLES {
+				return fmt.Errorf(
+					"%d consecutive failed sync cycles, last error: %w", failedCycles, err,
+				)
+			}
+
+			next := sched.Next(time.Now())
+			slog.Error(
+				"S3 sync failed, running in degraded state",
+				"error", err,
+				"failed_cycles", failedCycles,
+				"max_failed_cycles", *env.SYNC_MAX_FAILED_CYCLES,
+				"next_execution", formatNext(next),
+			)
+			if req, ok = waitNext(ctx, next); !ok {
+				break
+			}
+			continue
+		}
+
+		if failedCycles > 0 {
+			slog.Info("S3 sync recovered from degraded state", "failed_cycles", failedCycles)
+			failedCycles = 0
+			metrics.SyncConsecutiveFailures.Set(0)
 		}
 
 		executions++
-		slog.Info(
-			"S3 Synced",
+		next := sched.Next(time.Now())
+		attrs := append(rep.logAttrs(),
 			"executions", executions,
-			"interval", *env.SYNC_INTERVAL,
-			"timestamp", time.Now().Format(time.RFC3339),
-			"next_execution", time.Now().Add(dur).Format(time.RFC3339),
+			"next_execution", formatNext(next),
 			"mode", *env.SYNC_MODE,
 			"resync", shouldResync,
 		)
-		time.Sleep(dur)
+		slog.Info("S3 sync cycle completed", attrs...)
+		if req, ok = waitNext(ctx, next); !ok {
+			break
+		}
 	}
+
+	slog.Info("rclone loop stopped")
+	return nil
+}
+
+// FinalSync runs a last bisync when shutting down, so the files uploaded
+// since the last cycle reach S3. In sync mode S3 is mirrored into the local
+// directory and nothing is ever pushed, so there is nothing to do. It waits
+// for any triggered run still in progress, so they never overlap.
+func FinalSync(env *config.Env) error {
+	if *env.SYNC_MODE != "bisync" {
+		slog.Info("sync mode only pulls from S3, skipping final sync")
+		return nil
+	}
+
+	slog.Info("running final sync...")
+	syncMu.Lock()
+	health.SyncStarted()
+	rep, err := runBisync(env, !hasBisyncState(*env.SYNC_BISYNC_WORKDIR), false)
+	health.SyncFinished(err == nil)
+	syncMu.Unlock()
+	recordMetrics(rep, err)
+	if err != nil {
+		return fmt.Errorf("final sync error: %w", err)
+	}
+
+	slog.Info("final sync completed", rep.logAttrs()...)
+	return nil
+}
+
+// SyncOnce runs a single sync cycle, with its retries, outside of the loop.
+// It ignores the schedule and the blackout windows, as it is run by hand.
+//
+// With dryRun nothing is changed, and the files that would be copied or
+// deleted are written to out per user and direction.
+func SyncOnce(ctx context.Context, env *config.Env, dryRun bool, out io.Writer) error {
+	// A running instance may share the bisync workdir, never remove its locks
+	staleLocksOnce.Do(func() {})
+
+	shouldResync := *env.SYNC_MODE == "bisync" && !hasBisyncState(*env.SYNC_BISYNC_WORKDIR)
+	rep, err := runWithRetries(ctx, env, syncFuncFor(env, dryRun), shouldResync)
+	if err != nil {
+		return err
+	}
+
+	attrs := append(rep.logAttrs(),
+		"mode", *env.SYNC_MODE,
+		"resync", shouldResync,
+		"dry_run", dryRun,
+	)
+	slog.Info("S3 sync completed", attrs...)
+	if dryRun {
+		return writePlan(out, rep.Planned)
+	}
+	return nil
 }
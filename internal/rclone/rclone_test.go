@@ -0,0 +1,218 @@
+package rclone
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"s3ftp/internal/config"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestEnv returns a valid env using static credentials and a conf file.
+func newTestEnv() *config.Env {
+	str := func(s string) *string { return &s }
+	return &config.Env{
+		SFTP_USERS:                   str("user1:pass1,user2:pass2:ro"),
+		S3_AUTH_MODE:                 str(config.S3AuthModeStatic),
+		S3_ACCESS_KEY_ID:             str("key"),
+		S3_SECRET_ACCESS_KEY:         str("secret"),
+		S3_REGION:                    str("us-east-1"),
+		S3_ENDPOINT:                  str("s3.example.com"),
+		S3_BUCKET:                    str("bucket"),
+		S3_CONF_MODE:                 str(config.S3ConfModeFile),
+		S3_SSE:                       str(config.S3SSENone),
+		S3_INSECURE_SKIP_VERIFY:      func() *bool { b := false; return &b }(),
+		S3_CRYPT_FILENAME_ENCRYPTION: str("off"),
+		SYNC_INTERVAL:                str("15m"),
+		SYNC_SCHEDULE:                str(""),
+		SYNC_BLACKOUT_WINDOWS:        str(""),
+		SYNC_TIMEZONE:                str("UTC"),
+		SYNC_MODE:                    str("sync"),
+		SYNC_SETTLE_TIME:             str("2s"),
+		SYNC_BISYNC_WORKDIR:          str("/var/lib/s3ftp/bisync"),
+		SYNC_CONFLICT_RESOLVE:        str(config.SyncConflictKeepBoth),
+		SYNC_CONFLICT_SUFFIX:         str("conflict"),
+		SYNC_CONFLICTS_DIR:           str(""),
+		SYNC_TRASH_PREFIX:            str(""),
+		SYNC_TRASH_RETENTION:         str("720h"),
+		SYNC_MAX_DELETE:              func() *int { i := 0; return &i }(),
+		SYNC_MAX_DELETE_PERCENT:      func() *int { i := 50; return &i }(),
+		SYNC_CHECK_ACCESS_FILE:       str(""),
+		SYNC_TIMEOUT:                 str("0s"),
+		SYNC_STALL_TIMEOUT:           str("10m"),
+		SYNC_RCD:                     func() *bool { b := false; return &b }(),
+		SYNC_RCD_ADDR:                str("127.0.0.1:5572"),
+		SYNC_RETRIES:                 func() *int { i := 2; return &i }(),
+		SYNC_RETRY_BACKOFF:           str("1ms"),
+		SYNC_RETRY_MAX_BACKOFF:       str("2ms"),
+		SYNC_MAX_FAILED_CYCLES:       func() *int { i := 5; return &i }(),
+	}
+}
+
+func TestBuildConf(t *testing.T) {
+	// Test static credentials
+	env := newTestEnv()
+	conf := buildConf(env)
+	assert.Contains(t, conf, "access_key_id = key\n")
+	assert.Contains(t, conf, "secret_access_key = secret\n")
+	assert.NotContains(t, conf, "env_auth")
+	assert.NotContains(t, conf, "session_token")
+
+	// Test static credentials with a session token
+	token := "token"
+	env.AWS_SESSION_TOKEN = &token
+	conf = buildConf(env)
+	assert.Contains(t, conf, "session_token = token\n")
+
+	// Test ambient credentials, static keys must not be written
+	mode := config.S3AuthModeEnv
+	env.S3_AUTH_MODE = &mode
+	conf = buildConf(env)
+	assert.Contains(t, conf, "env_auth = true\n")
+	assert.NotContains(t, conf, "access_key_id")
+	assert.NotContains(t, conf, "session_token")
+}
+
+func TestEndpointAddress(t *testing.T) {
+	// Test endpoint without scheme defaults to https
+	addr, isTLS, err := endpointAddress("s3.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3.example.com:443", addr)
+	assert.True(t, isTLS)
+
+	// Test endpoint with custom port
+	addr, isTLS, err = endpointAddress("https://minio.internal:9000")
+	assert.NoError(t, err)
+	assert.Equal(t, "minio.internal:9000", addr)
+	assert.True(t, isTLS)
+
+	// Test plain http endpoint
+	addr, isTLS, err = endpointAddress("http://minio.internal")
+	assert.NoError(t, err)
+	assert.Equal(t, "minio.internal:80", addr)
+	assert.False(t, isTLS)
+
+	// Test endpoint without host
+	_, _, err = endpointAddress("https://")
+	assert.Error(t, err)
+}
+
+func TestCheckEndpointTLS(t *testing.T) {
+	env := newTestEnv()
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	endpoint := srv.URL
+	env.S3_ENDPOINT = &endpoint
+
+	writeCA := func(cert *x509.Certificate) string {
+		path := filepath.Join(t.TempDir(), "ca.pem")
+		block := &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0644))
+		return path
+	}
+
+	// Test the endpoint is trusted through the CA bundle
+	bundle := writeCA(srv.Certificate())
+	env.S3_CA_BUNDLE = &bundle
+	assert.NoError(t, CheckEndpointTLS(env))
+
+	// Test only the CA bundle is trusted, like rclone --ca-cert does
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "other CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	otherCA, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	bundle = writeCA(otherCA)
+	env.S3_CA_BUNDLE = &bundle
+	assert.ErrorContains(t, CheckEndpointTLS(env), "error validating TLS")
+
+	// Test an unreachable endpoint is not a startup error
+	srv.Close()
+	assert.NoError(t, CheckEndpointTLS(env))
+}
+
+func TestGlobalFlags(t *testing.T) {
+	// Test no TLS options
+	env := newTestEnv()
+	assert.Empty(t, globalFlags(env))
+
+	// Test all TLS options
+	ca, cert, key, insecure := "/ca.pem", "/cert.pem", "/key.pem", true
+	env.S3_CA_BUNDLE = &ca
+	env.S3_CLIENT_CERT = &cert
+	env.S3_CLIENT_KEY = &key
+	env.S3_INSECURE_SKIP_VERIFY = &insecure
+	assert.Equal(t, []string{
+		"--ca-cert", ca,
+		"--client-cert", cert,
+		"--client-key", key,
+		"--no-check-certificate",
+	}, globalFlags(env))
+}
+
+func TestRunWithRetries(t *testing.T) {
+	env := newTestEnv()
+
+	// Test a transient failure is retried until it succeeds
+	calls := 0
+	_, err := runWithRetries(context.Background(), env, func(_ *config.Env, _ bool) (report, error) {
+		calls++
+		if calls < 3 {
+			return report{}, errors.New("transient")
+		}
+		return report{}, nil
+	}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	// Test the last error is returned once the retries are exhausted
+	calls = 0
+	_, err = runWithRetries(context.Background(), env, func(_ *config.Env, _ bool) (report, error) {
+		calls++
+		return report{}, errors.New("permanent")
+	}, false)
+	assert.EqualError(t, err, "permanent")
+	assert.Equal(t, 1+*env.SYNC_RETRIES, calls)
+
+	// Test a safety abort is not retried
+	calls = 0
+	_, err = runWithRetries(context.Background(), env, func(_ *config.Env, _ bool) (report, error) {
+		calls++
+		return report{}, errSafetyAbort
+	}, false)
+	assert.ErrorIs(t, err, errSafetyAbort)
+	assert.Equal(t, 1, calls)
+
+	// Test a run killed by the watchdog is not retried
+	calls = 0
+	_, err = runWithRetries(context.Background(), env, func(_ *config.Env, _ bool) (report, error) {
+		calls++
+		return report{}, errRunKilled
+	}, false)
+	assert.ErrorIs(t, err, errRunKilled)
+	assert.Equal(t, 1, calls)
+}
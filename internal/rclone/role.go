@@ -0,0 +1,82 @@
+package rclone
+
+import (
+	"fmt"
+	"s3ftp/internal/config"
+	"strings"
+)
+
+const (
+	// awsConfigPath is the AWS shared config file holding the profile that
+	// assumes S3_ROLE_ARN, it holds no secrets
+	awsConfigPath = "/root/.config/rclone/aws-config"
+	// roleProfile is the AWS profile that assumes S3_ROLE_ARN
+	roleProfile = "s3ftp"
+	// webIdentityProfile is the AWS profile of the web identity (EKS IRSA)
+	// credentials the role is assumed with
+	webIdentityProfile = "s3ftp-web-identity"
+)
+
+// roleEnabled reports whether S3_ROLE_ARN is assumed before accessing the
+// bucket.
+func roleEnabled(env *config.Env) bool {
+	return env.S3_ROLE_ARN != nil && *env.S3_ROLE_ARN != ""
+}
+
+// roleRemoteOptions returns the s3 remote options that make rclone assume
+// S3_ROLE_ARN. rclone has no role_arn option before 1.70, but with env_auth
+// and no static keys the AWS SDK loads the selected profile from the shared
+// config file, and assumes its role.
+func roleRemoteOptions() []option {
+	return []option{
+		{"env_auth", "true"},
+		{"profile", roleProfile},
+		{"shared_credentials_file", awsConfigPath},
+	}
+}
+
+// roleConf returns the AWS shared config file with the profile that assumes
+// S3_ROLE_ARN. The role is assumed with the static keys, passed to rclone in
+// its env by roleEnv, or with the ambient credentials found with getenv.
+func roleConf(env *config.Env, getenv func(string) string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s]\n", roleProfile)
+	fmt.Fprintf(&b, "role_arn = %s\n", *env.S3_ROLE_ARN)
+	fmt.Fprintf(&b, "role_session_name = s3ftp\n")
+
+	switch {
+	case *env.S3_AUTH_MODE == config.S3AuthModeStatic || getenv("AWS_ACCESS_KEY_ID") != "":
+		b.WriteString("credential_source = Environment\n")
+	case getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "":
+		// The role of the service account is assumed first
+		fmt.Fprintf(&b, "source_profile = %s\n", webIdentityProfile)
+		fmt.Fprintf(&b, "\n[%s]\n", webIdentityProfile)
+		fmt.Fprintf(&b, "role_arn = %s\n", getenv("AWS_ROLE_ARN"))
+		fmt.Fprintf(&b, "web_identity_token_file = %s\n", getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	case getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" ||
+		getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "":
+		b.WriteString("credential_source = EcsContainer\n")
+	default:
+		b.WriteString("credential_source = Ec2InstanceMetadata\n")
+	}
+
+	return b.String()
+}
+
+// roleEnv returns the env vars with the static keys the role is assumed
+// with, which are not written to the rclone remote, as the AWS SDK ignores
+// the profile when it has keys.
+func roleEnv(env *config.Env) []string {
+	if !roleEnabled(env) || *env.S3_AUTH_MODE != config.S3AuthModeStatic {
+		return nil
+	}
+
+	vars := []string{
+		"AWS_ACCESS_KEY_ID=" + *env.S3_ACCESS_KEY_ID,
+		"AWS_SECRET_ACCESS_KEY=" + *env.S3_SECRET_ACCESS_KEY,
+	}
+	if env.AWS_SESSION_TOKEN != nil && *env.AWS_SESSION_TOKEN != "" {
+		vars = append(vars, "AWS_SESSION_TOKEN="+*env.AWS_SESSION_TOKEN)
+	}
+	return vars
+}
@@ -0,0 +1,95 @@
+package rclone
+
+import (
+	"s3ftp/internal/config"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// parseProfiles parses an AWS shared config file into its sections.
+func parseProfiles(t *testing.T, content string) map[string]map[string]string {
+	profiles := map[string]map[string]string{}
+	section := ""
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "["):
+			section = strings.Trim(line, "[]")
+			profiles[section] = map[string]string{}
+		default:
+			key, value, ok := strings.Cut(line, " = ")
+			require.True(t, ok, line)
+			profiles[section][key] = value
+		}
+	}
+	return profiles
+}
+
+// remoteOptions returns the options of the s3 remote as a map.
+func remoteOptions(env *config.Env) map[string]string {
+	opts := map[string]string{}
+	for _, o := range s3Remote(env).options {
+		opts[o.key] = o.value
+	}
+	return opts
+}
+
+func TestRole(t *testing.T) {
+	env := newTestEnv()
+	role := "arn:aws:iam::123456789012:role/s3ftp"
+	env.S3_ROLE_ARN = &role
+	noEnv := func(string) string { return "" }
+
+	// Test the remote selects the profile from the shared config, without
+	// static keys, which would make the AWS SDK ignore the profile
+	opts := remoteOptions(env)
+	assert.Equal(t, "true", opts["env_auth"])
+	assert.NotContains(t, opts, "access_key_id")
+	assert.NotContains(t, opts, "secret_access_key")
+	assert.NotContains(t, opts, "role_arn")
+
+	// Test the profile assumes the role with the static keys, which only
+	// reach rclone through its env
+	profiles := parseProfiles(t, roleConf(env, noEnv))
+	assert.Equal(t, opts["shared_credentials_file"], awsConfigPath)
+	profile := profiles[opts["profile"]]
+	require.NotNil(t, profile)
+	assert.Equal(t, role, profile["role_arn"])
+	assert.Equal(t, "Environment", profile["credential_source"])
+	vars := newCommand(env).Env
+	assert.Contains(t, vars, "AWS_ACCESS_KEY_ID=key")
+	assert.Contains(t, vars, "AWS_SECRET_ACCESS_KEY=secret")
+	assert.NotContains(t, buildConf(env), "secret")
+
+	// Test the role is assumed with the ambient credentials
+	mode := config.S3AuthModeEnv
+	env.S3_AUTH_MODE = &mode
+	assert.Empty(t, roleEnv(env))
+
+	profiles = parseProfiles(t, roleConf(env, noEnv))
+	assert.Equal(t, "Ec2InstanceMetadata", profiles[roleProfile]["credential_source"])
+
+	ecs := map[string]string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/v2/credentials"}
+	profiles = parseProfiles(t, roleConf(env, func(k string) string { return ecs[k] }))
+	assert.Equal(t, "EcsContainer", profiles[roleProfile]["credential_source"])
+
+	// Test the role is chained after the role of the service account
+	irsa := map[string]string{
+		"AWS_ROLE_ARN":                "arn:aws:iam::123456789012:role/pod",
+		"AWS_WEB_IDENTITY_TOKEN_FILE": "/var/run/secrets/token",
+	}
+	profiles = parseProfiles(t, roleConf(env, func(k string) string { return irsa[k] }))
+	source := profiles[profiles[roleProfile]["source_profile"]]
+	require.NotNil(t, source)
+	assert.Equal(t, irsa["AWS_ROLE_ARN"], source["role_arn"])
+	assert.Equal(t, irsa["AWS_WEB_IDENTITY_TOKEN_FILE"], source["web_identity_token_file"])
+
+	// Test nothing changes without a role
+	env.S3_ROLE_ARN = nil
+	assert.NotContains(t, remoteOptions(env), "profile")
+	assert.Empty(t, roleEnv(env))
+}
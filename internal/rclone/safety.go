@@ -0,0 +1,146 @@
+package rclone
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"s3ftp/internal/config"
+	"s3ftp/internal/metrics"
+	"strconv"
+	"strings"
+)
+
+// errSafetyAbort is returned when a run is stopped by a safety check, it is
+// not retried as retrying would hit the same check
+var errSafetyAbort = errors.New("sync aborted by a safety check")
+
+// bisyncSafetyAbort matches the bisync message logged when the deletions
+// exceed --max-delete, e.g. "Safety abort: too many deletes (>50%, 10 of 12)"
+var bisyncSafetyAbort = regexp.MustCompile(`too many deletes \(>\d+%, (\d+) of \d+\)`)
+
+// bisyncDeleted matches the delta bisync logs, before applying any change,
+// for every file deleted on one side since the last run, which it then
+// deletes on the other, e.g.
+// "- Path1    File was deleted          - user/user/a.txt"
+var bisyncDeleted = regexp.MustCompile(`File was deleted\s+-\s+(.+)$`)
+
+// deletedPath returns the path of the file reported as deleted in a bisync
+// delta message.
+func deletedPath(msg string) (string, bool) {
+	return matchPath(bisyncDeleted, msg)
+}
+
+// blockedDeletes returns the number of deletions blocked by --max-delete
+// reported in an rclone log message. sync logs every blocked deletion and
+// bisync logs a single message with the total.
+func blockedDeletes(msg string) int64 {
+	if strings.Contains(msg, "--max-delete threshold reached") {
+		return 1
+	}
+	if m := bisyncSafetyAbort.FindStringSubmatch(msg); m != nil {
+		n, _ := strconv.ParseInt(m[1], 10, 64)
+		return n
+	}
+	return 0
+}
+
+// countFiles returns the number of regular files under root.
+func countFiles(root string) int {
+	count := 0
+	_ = filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+// minMaxDelete is the lowest limit SYNC_MAX_DELETE_PERCENT sets in sync mode,
+// so a small tree can still delete a few files
+const minMaxDelete = 10
+
+// maxDeleteFlags returns the --max-delete flag for a run, combining
+// SYNC_MAX_DELETE and SYNC_MAX_DELETE_PERCENT of the given number of local
+// files into the strictest limit.
+//
+// sync takes a number of files, while bisync takes a percentage of the files
+// on each side, so for bisync only SYNC_MAX_DELETE_PERCENT is passed and the
+// watchdog enforces the absolute limit on the deletions bisync plans.
+func maxDeleteFlags(env *config.Env, files int) []string {
+	maxDelete := *env.SYNC_MAX_DELETE
+	percent := *env.SYNC_MAX_DELETE_PERCENT
+
+	if *env.SYNC_MODE == "bisync" {
+		if percent == 0 {
+			return nil
+		}
+		return []string{"--max-delete", strconv.Itoa(percent)}
+	}
+
+	if percent > 0 {
+		converted := max(files*percent/100, minMaxDelete)
+		if maxDelete == 0 || converted < maxDelete {
+			maxDelete = converted
+		}
+	}
+	if maxDelete == 0 {
+		return nil
+	}
+	return []string{"--max-delete", strconv.Itoa(maxDelete)}
+}
+
+// checkAccess checks the SYNC_CHECK_ACCESS_FILE marker exists at the root
+// of the remote, so a mistyped bucket or an empty listing never makes the
+// sync delete every local file. It does nothing if the marker is not set.
+func checkAccess(env *config.Env) error {
+	marker := *env.SYNC_CHECK_ACCESS_FILE
+	if marker == "" {
+		return nil
+	}
+
+	out, err := output(
+		env, "lsf", syncRemote(env),
+		"--files-only", "--max-depth", "1", "--include", escapeFilter(marker),
+	)
+	if err != nil {
+		return fmt.Errorf("error checking access marker: %w", err)
+	}
+
+	if strings.TrimSpace(string(out)) != marker {
+		metrics.SyncAborts.Inc(metrics.AbortCheckAccess)
+		slog.Error(
+			"ALERT: access marker not found in S3, sync aborted to protect the local files",
+			"marker", marker,
+			"bucket", *env.S3_BUCKET,
+		)
+		return fmt.Errorf("%w: access marker %s not found", errSafetyAbort, marker)
+	}
+
+	return nil
+}
+
+// checkDeletes raises an alert and returns a safety abort error when the run
+// was stopped by --max-delete, otherwise it returns err.
+func checkDeletes(env *config.Env, rep report, err error) error {
+	if rep.DeletesBlocked == 0 {
+		return err
+	}
+
+	metrics.SyncAborts.Inc(metrics.AbortMaxDelete)
+	metrics.SyncDeletesBlocked.Add(*env.SYNC_MODE, float64(rep.DeletesBlocked))
+	slog.Error(
+		"ALERT: sync would delete too many files, deletions blocked",
+		"deletes_blocked", rep.DeletesBlocked,
+		"max_delete", *env.SYNC_MAX_DELETE,
+		"max_delete_percent", *env.SYNC_MAX_DELETE_PERCENT,
+		"mode", *env.SYNC_MODE,
+	)
+	if err == nil {
+		return fmt.Errorf("%w: %d deletions blocked", errSafetyAbort, rep.DeletesBlocked)
+	}
+	return fmt.Errorf("%w: %d deletions blocked: %w", errSafetyAbort, rep.DeletesBlocked, err)
+}
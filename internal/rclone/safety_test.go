@@ -0,0 +1,134 @@
+package rclone
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockedDeletes(t *testing.T) {
+	assert.Equal(t, int64(1), blockedDeletes("Got fatal error on delete: --max-delete threshold reached"))
+	assert.Equal(t, int64(10), blockedDeletes(
+		"Safety abort: too many deletes (>50%, 10 of 12) on Path1 deletes \"/home/\". Run with --force if desired.",
+	))
+	assert.Equal(t, int64(0), blockedDeletes("Deleted"))
+}
+
+func TestCountFiles(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "user", "user"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "user", "user", "a.txt"), nil, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "user", "user", "b.txt"), nil, 0644))
+
+	assert.Equal(t, 2, countFiles(root))
+}
+
+func TestMaxDeleteFlags(t *testing.T) {
+	env := newTestEnv()
+	set := func(maxDelete, percent int) {
+		env.SYNC_MAX_DELETE = &maxDelete
+		env.SYNC_MAX_DELETE_PERCENT = &percent
+	}
+
+	// Test sync takes the strictest limit as a number of files
+	set(0, 0)
+	assert.Nil(t, maxDeleteFlags(env, 1000))
+	set(0, 50)
+	assert.Equal(t, []string{"--max-delete", "500"}, maxDeleteFlags(env, 1000))
+
+	// Test the percentage never blocks every deletion of a small tree
+	set(0, 50)
+	assert.Equal(t, []string{"--max-delete", "10"}, maxDeleteFlags(env, 1))
+	set(0, 50)
+	assert.Equal(t, []string{"--max-delete", "10"}, maxDeleteFlags(env, 0))
+	set(5, 50)
+	assert.Equal(t, []string{"--max-delete", "5"}, maxDeleteFlags(env, 0))
+	set(100, 50)
+	assert.Equal(t, []string{"--max-delete", "100"}, maxDeleteFlags(env, 1000))
+	set(800, 50)
+	assert.Equal(t, []string{"--max-delete", "500"}, maxDeleteFlags(env, 1000))
+	set(100, 0)
+	assert.Equal(t, []string{"--max-delete", "100"}, maxDeleteFlags(env, 1000))
+
+	// Test bisync only takes the percentage, the absolute limit is checked on
+	// the planned deletions
+	mode := "bisync"
+	env.SYNC_MODE = &mode
+	set(0, 0)
+	assert.Nil(t, maxDeleteFlags(env, 1000))
+	set(0, 50)
+	assert.Equal(t, []string{"--max-delete", "50"}, maxDeleteFlags(env, 1000))
+	set(1, 50)
+	assert.Equal(t, []string{"--max-delete", "50"}, maxDeleteFlags(env, 1000))
+	set(100, 0)
+	assert.Nil(t, maxDeleteFlags(env, 200))
+}
+
+func TestDeletedPath(t *testing.T) {
+	path, ok := deletedPath("- Path1    File was deleted          - user1/user1/a.txt")
+	assert.True(t, ok)
+	assert.Equal(t, "user1/user1/a.txt", path)
+
+	_, ok = deletedPath("- Path1    File changed: size (larger) - user1/user1/a.txt")
+	assert.False(t, ok)
+}
+
+// fakeRclone puts on the PATH an rclone that prints the given output.
+func fakeRclone(t *testing.T, output string) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\ncat <<'EOF'\n" + output + "\nEOF\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "rclone"), []byte(script), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestBisyncDeleteLimit(t *testing.T) {
+	env := newTestEnv()
+	fakeRclone(t, strings.Join([]string{
+		`{"level":"info","msg":"- Path1    File was deleted          - user1/user1/a.txt"}`,
+		`{"level":"info","msg":"- Path2    File was deleted          - user1/user1/b.txt"}`,
+		`{"level":"info","msg":"- Path2    File was deleted          - user1/user1/c.txt"}`,
+		`EOF`,
+		`sleep 60`,
+		`cat <<'EOF'`,
+	}, "\n"))
+	args := []string{"bisync", "s3:bucket/", "/home"}
+
+	// Test the run is stopped before applying more deletions than the limit
+	maxDelete := 2
+	env.SYNC_MAX_DELETE = &maxDelete
+	start := time.Now()
+	rep, err := run(env, args...)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, int64(3), rep.DeletesBlocked)
+	err = checkDeletes(env, rep, err)
+	assert.ErrorIs(t, err, errSafetyAbort)
+	assert.ErrorContains(t, err, "3 deletions blocked")
+
+	// Test a dry run is not stopped by the limit, it reports every planned
+	// change, only by the timeout
+	timeout := "200ms"
+	env.SYNC_TIMEOUT = &timeout
+	rep, err = run(env, append(args, "--dry-run")...)
+	assert.ErrorIs(t, err, errRunKilled)
+	assert.Zero(t, rep.DeletesBlocked)
+}
+
+func TestCheckDeletes(t *testing.T) {
+	env := newTestEnv()
+	runErr := errors.New("exit status 7")
+
+	// Test the error is returned as is when nothing was blocked
+	assert.Equal(t, runErr, checkDeletes(env, report{}, runErr))
+	assert.NoError(t, checkDeletes(env, report{}, nil))
+
+	// Test blocked deletions are a safety abort
+	err := checkDeletes(env, report{DeletesBlocked: 3}, runErr)
+	assert.ErrorIs(t, err, errSafetyAbort)
+	assert.ErrorIs(t, err, runErr)
+}
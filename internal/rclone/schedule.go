@@ -0,0 +1,39 @@
+package rclone
+
+import (
+	"context"
+	"s3ftp/internal/backoff"
+	"s3ftp/internal/config"
+	"s3ftp/internal/schedule"
+	"time"
+)
+
+// newSchedule returns the sync schedule: SYNC_SCHEDULE crons or else every
+// SYNC_INTERVAL, never inside the SYNC_BLACKOUT_WINDOWS.
+func newSchedule(env *config.Env) (*schedule.Schedule, error) {
+	interval, err := time.ParseDuration(*env.SYNC_INTERVAL)
+	if err != nil {
+		return nil, err
+	}
+	return schedule.Parse(
+		interval, *env.SYNC_SCHEDULE, *env.SYNC_BLACKOUT_WINDOWS, *env.SYNC_TIMEZONE,
+	)
+}
+
+// sleepUntil waits until t, it returns false if ctx is done first. A zero t
+// means the schedule never runs again, so it waits for ctx.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	if t.IsZero() {
+		<-ctx.Done()
+		return false
+	}
+	return backoff.Sleep(ctx, time.Until(t))
+}
+
+// formatNext formats the time of the next sync for the logs.
+func formatNext(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
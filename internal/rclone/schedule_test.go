@@ -0,0 +1,37 @@
+package rclone
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSchedule(t *testing.T) {
+	env := newTestEnv()
+
+	// Test SYNC_INTERVAL is used without crons
+	sched, err := newSchedule(env)
+	require.NoError(t, err)
+	now := time.Date(2024, 6, 3, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, now.Add(15*time.Minute), sched.Next(now))
+
+	// Test the crons replace the interval
+	crons := "0 * * * *"
+	env.SYNC_SCHEDULE = &crons
+	sched, err = newSchedule(env)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(time.Hour), sched.Next(now))
+}
+
+func TestSleepUntil(t *testing.T) {
+	assert.True(t, sleepUntil(context.Background(), time.Now().Add(time.Millisecond)))
+
+	// Test a schedule that never runs again waits for ctx
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.False(t, sleepUntil(ctx, time.Time{}))
+	assert.Equal(t, "never", formatNext(time.Time{}))
+}
@@ -0,0 +1,65 @@
+package rclone
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"s3ftp/internal/config"
+	"time"
+)
+
+// snapshotRoot is the directory holding the snapshot users chroots, outside
+// of the synced local root
+const snapshotRoot = "/snapshots"
+
+// snapshotArgs returns the rclone arguments that mirror the directory of the
+// snapshot user in S3, as it was at the snapshot time, into its chroot. The
+// S3 backend is read-only with --s3-version-at, so nothing is written back.
+func snapshotArgs(env *config.Env, user config.SnapshotUser) []string {
+	return []string{
+		"sync",
+		syncRemote(env) + path.Join(user.User, user.User),
+		filepath.Join(snapshotRoot, user.Username, user.Username),
+		"--s3-version-at", user.At.UTC().Format(time.RFC3339),
+	}
+}
+
+// PopulateSnapshots fills the directory of every snapshot user from the S3
+// object versions at its snapshot time, and then calls enable so the user
+// can log in, never to an empty directory. A failed snapshot is logged, its
+// user stays disabled, and the others are still populated. It stops early
+// when ctx is done.
+func PopulateSnapshots(ctx context.Context, env *config.Env, enable func(config.SnapshotUser) error) error {
+	users, err := config.SnapshotUsers(env)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		attrs := []any{
+			"user", user.Username,
+			"source", user.User,
+			"at", user.At.Format(time.RFC3339),
+		}
+		slog.Info("populating snapshot", attrs...)
+
+		rep, err := run(env, snapshotArgs(env, user)...)
+		if err != nil {
+			slog.Error("error populating snapshot", append(attrs, "error", fmt.Errorf("error: %w", err))...)
+			continue
+		}
+		slog.Info("snapshot populated", append(attrs, rep.logAttrs()...)...)
+
+		if err := enable(user); err != nil {
+			slog.Error("error enabling snapshot user", append(attrs, "error", err)...)
+		}
+	}
+
+	return nil
+}
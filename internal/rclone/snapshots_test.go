@@ -0,0 +1,26 @@
+package rclone
+
+import (
+	"s3ftp/internal/config"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotArgs(t *testing.T) {
+	env := newTestEnv()
+	user := config.SnapshotUser{
+		Username: "audit1",
+		User:     "partner1",
+		At:       time.Date(2024, 6, 1, 12, 0, 0, 0, time.FixedZone("", 2*60*60)),
+	}
+
+	// Test the partner directory is mirrored read-only at the snapshot time
+	assert.Equal(t, []string{
+		"sync",
+		"s3:bucket/partner1/partner1",
+		"/snapshots/audit1/audit1",
+		"--s3-version-at", "2024-06-01T10:00:00Z",
+	}, snapshotArgs(env, user))
+}
@@ -0,0 +1,156 @@
+package rclone
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"s3ftp/internal/config"
+	"strings"
+	"time"
+)
+
+// tlsCheckTimeout is the maximum time to wait for the TLS handshake
+const tlsCheckTimeout = 10 * time.Second
+
+// endpointAddress returns the host:port of the S3 endpoint and whether it
+// uses TLS. Endpoints without a scheme are treated as https, like rclone does.
+func endpointAddress(endpoint string) (string, bool, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", false, fmt.Errorf("error parsing S3_ENDPOINT: %w", err)
+	}
+	if u.Hostname() == "" {
+		return "", false, errors.New("S3_ENDPOINT has no host")
+	}
+
+	isTLS := u.Scheme == "https"
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if isTLS {
+			port = "443"
+		}
+	}
+
+	return net.JoinHostPort(u.Hostname(), port), isTLS, nil
+}
+
+// tlsConfig returns the TLS configuration rclone will use for the endpoint.
+func tlsConfig(env *config.Env, serverName string) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: *env.S3_INSECURE_SKIP_VERIFY,
+	}
+
+	if env.S3_CA_BUNDLE != nil && *env.S3_CA_BUNDLE != "" {
+		pem, err := os.ReadFile(*env.S3_CA_BUNDLE)
+		if err != nil {
+			return nil, fmt.Errorf("error reading S3_CA_BUNDLE: %w", err)
+		}
+		// rclone --ca-cert trusts only the bundle, not the system CAs
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("S3_CA_BUNDLE contains no valid certificates")
+		}
+		conf.RootCAs = pool
+	}
+
+	if env.S3_CLIENT_CERT != nil && *env.S3_CLIENT_CERT != "" {
+		cert, err := tls.LoadX509KeyPair(*env.S3_CLIENT_CERT, *env.S3_CLIENT_KEY)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return conf, nil
+}
+
+// isCertError reports whether err is a certificate problem: the endpoint
+// certificate is not trusted or not valid for its host, or the endpoint
+// rejected the client certificate.
+func isCertError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var unknownErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var hostErr x509.HostnameError
+	var alertErr tls.AlertError
+	return errors.As(err, &verifyErr) ||
+		errors.As(err, &unknownErr) ||
+		errors.As(err, &invalidErr) ||
+		errors.As(err, &hostErr) ||
+		errors.As(err, &alertErr)
+}
+
+// CheckEndpointTLS performs a TLS handshake against the S3 endpoint using the
+// configured CA bundle, client certificate and proxy, so that certificate
+// problems are reported at startup instead of on the first sync. Only those
+// are returned, an unreachable endpoint is logged and checked by the syncs.
+func CheckEndpointTLS(env *config.Env) error {
+	addr, isTLS, err := endpointAddress(*env.S3_ENDPOINT)
+	if err != nil {
+		return err
+	}
+
+	if !isTLS {
+		slog.Warn("S3 endpoint does not use TLS, skipping TLS check", "endpoint", *env.S3_ENDPOINT)
+		return nil
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	conf, err := tlsConfig(env, host)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Timeout: tlsCheckTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: conf,
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return proxyForHost(env, r.URL.Hostname())
+			},
+		},
+	}
+
+	// Any HTTP response, even an access denied one, means the TLS handshake
+	// succeeded
+	res, err := client.Head("https://" + addr + "/")
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		// The error may include the proxy URL and its credentials
+		if !isCertError(err) {
+			slog.Warn(
+				"S3 endpoint unreachable, skipping TLS check",
+				"endpoint", addr,
+				"error", redactProxy(env, err.Error()),
+			)
+			return nil
+		}
+		return fmt.Errorf(
+			"error validating TLS for %s: %s", addr, redactProxy(env, err.Error()),
+		)
+	}
+	res.Body.Close()
+
+	proxy, _ := proxyForHost(env, host)
+	if proxy != nil {
+		slog.Info("S3 endpoint TLS validated", "endpoint", addr, "proxy", proxy.Redacted())
+	} else {
+		slog.Info("S3 endpoint TLS validated", "endpoint", addr)
+	}
+	return nil
+}
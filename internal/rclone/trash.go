@@ -0,0 +1,247 @@
+package rclone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"s3ftp/internal/backoff"
+	"s3ftp/internal/config"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// trashStampLayout is the layout of the dated folders in the trash, without
+// colons so it is a valid path everywhere
+const trashStampLayout = "2006-01-02T150405Z"
+
+// trashPurgeInterval is how often the trash older than the retention is purged
+const trashPurgeInterval = time.Hour
+
+// trashEnabled reports whether deleted and overwritten files are kept in the
+// trash.
+func trashEnabled(env *config.Env) bool {
+	return *env.SYNC_TRASH_PREFIX != ""
+}
+
+// trashRemote returns the rclone path of the trash, or of one of its dated
+// folders if stamp is not empty.
+func trashRemote(env *config.Env, stamp string) string {
+	return syncRemote(env) + path.Join(*env.SYNC_TRASH_PREFIX, stamp)
+}
+
+// trashExcludeFlags returns the flags that keep the trash out of the synced
+// files. rclone only accepts a backup dir inside the destination when it is
+// excluded.
+func trashExcludeFlags(env *config.Env) []string {
+	if !trashEnabled(env) {
+		return nil
+	}
+	return []string{"--exclude", escapeFilter(*env.SYNC_TRASH_PREFIX) + "/**"}
+}
+
+// trashBackupFlags returns the flags that move the files deleted or
+// overwritten in S3 by a run into a new dated folder of the trash. bisync
+// takes the backup dir of each path, S3 being Path1.
+func trashBackupFlags(env *config.Env, flag string) []string {
+	if !trashEnabled(env) {
+		return nil
+	}
+	stamp := time.Now().UTC().Format(trashStampLayout)
+	return []string{flag, trashRemote(env, stamp)}
+}
+
+// trashStamps lists the dated folders of the trash, sorted from the oldest.
+func trashStamps(env *config.Env) ([]time.Time, error) {
+	out, err := output(env, "lsf", "--dirs-only", trashRemote(env, ""))
+	if err != nil {
+		return nil, fmt.Errorf("error listing trash: %w", err)
+	}
+	return parseTrashStamps(string(out)), nil
+}
+
+// parseTrashStamps parses an lsf listing of the trash, ignoring the entries
+// that are not dated folders.
+func parseTrashStamps(listing string) []time.Time {
+	stamps := []time.Time{}
+	for _, line := range strings.Split(listing, "\n") {
+		t, err := time.Parse(trashStampLayout, strings.TrimSuffix(strings.TrimSpace(line), "/"))
+		if err == nil {
+			stamps = append(stamps, t)
+		}
+	}
+	slices.SortFunc(stamps, func(a, b time.Time) int { return a.Compare(b) })
+	return stamps
+}
+
+// PurgeTrash deletes the dated folders of the trash older than
+// SYNC_TRASH_RETENTION. It does nothing if the retention is 0.
+func PurgeTrash(env *config.Env) error {
+	retention, err := time.ParseDuration(*env.SYNC_TRASH_RETENTION)
+	if err != nil || retention == 0 {
+		return err
+	}
+
+	stamps, err := trashStamps(env)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-retention)
+	purged := 0
+	for _, stamp := range stamps {
+		if !stamp.Before(cutoff) {
+			break
+		}
+		remote := trashRemote(env, stamp.Format(trashStampLayout))
+		if _, err := output(env, "purge", remote); err != nil {
+			return fmt.Errorf("error purging %s: %w", remote, err)
+		}
+		purged++
+	}
+
+	if purged > 0 {
+		slog.Info("trash purged", "folders", purged, "retention", *env.SYNC_TRASH_RETENTION)
+	}
+	return nil
+}
+
+// RunTrashRetention purges the trash older than SYNC_TRASH_RETENTION every
+// hour until ctx is done. A failed purge is only logged, it is retried on
+// the next run.
+func RunTrashRetention(ctx context.Context, env *config.Env) error {
+	if !trashEnabled(env) {
+		return nil
+	}
+
+	for {
+		if err := PurgeTrash(env); err != nil {
+			slog.Error("error purging trash", "error", err)
+		}
+		if !backoff.Sleep(ctx, trashPurgeInterval) {
+			return nil
+		}
+	}
+}
+
+// trashVersions returns the dated folders of the trash holding the given
+// path, relative to the local root, sorted from the oldest.
+func trashVersions(env *config.Env, relPath string) ([]string, error) {
+	pattern := "/*" + escapeFilter(relPath)
+	out, err := output(
+		env, "lsf", "--recursive", trashRemote(env, ""),
+		"--include", pattern, "--include", pattern+"/**",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error listing trash: %w", err)
+	}
+
+	stamps := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		stamp, _, found := strings.Cut(strings.TrimSpace(line), "/")
+		if found && !slices.Contains(stamps, stamp) {
+			stamps = append(stamps, stamp)
+		}
+	}
+	slices.Sort(stamps)
+	return stamps, nil
+}
+
+// pickTrashVersion returns the dated folder to restore from. Without at it
+// is the latest one. With at it is the first folder created after at, which
+// holds the version that was in place at that time.
+func pickTrashVersion(stamps []string, at time.Time) (string, bool) {
+	if len(stamps) == 0 {
+		return "", false
+	}
+	if at.IsZero() {
+		return stamps[len(stamps)-1], true
+	}
+
+	for _, stamp := range stamps {
+		t, err := time.Parse(trashStampLayout, stamp)
+		if err == nil && t.After(at) {
+			return stamp, true
+		}
+	}
+	return "", false
+}
+
+// Restore copies a file or directory of a user back from the trash into
+// the local directory, from where the next sync pushes it to S3. The path is
+// relative to the user directory. Without at the last deleted or overwritten
+// version is restored, otherwise the version that was in place at that time.
+func Restore(env *config.Env, user, userPath string, at time.Time) error {
+	if !trashEnabled(env) {
+		return errors.New("the trash is disabled, set SYNC_TRASH_PREFIX to enable it")
+	}
+	if err := checkUser(env, user); err != nil {
+		return err
+	}
+
+	userDir := path.Join(user, user)
+	relPath := path.Join(userDir, path.Clean("/"+userPath))
+	if relPath == userDir {
+		return errors.New("a path inside the user directory is required")
+	}
+
+	stamps, err := trashVersions(env, relPath)
+	if err != nil {
+		return err
+	}
+	stamp, ok := pickTrashVersion(stamps, at)
+	if !ok {
+		return fmt.Errorf("no version of %s found in the trash", userPath)
+	}
+
+	src := trashRemote(env, stamp) + "/" + relPath
+	dst := filepath.Join(localRoot, relPath)
+	if _, err := output(env, "copyto", src, dst); err != nil {
+		return fmt.Errorf("error restoring %s: %w", userPath, err)
+	}
+
+	// rclone runs as root, give the files back to the user
+	if err := chownLike(filepath.Join(localRoot, userDir), dst); err != nil {
+		return fmt.Errorf("error setting the owner of %s: %w", userPath, err)
+	}
+
+	slog.Info("file restored from trash", "user", user, "path", userPath, "version", stamp)
+	return nil
+}
+
+// chownLike gives the files under path, and its parent directories up to
+// base, the owner of base.
+func chownLike(base, path string) error {
+	info, err := os.Stat(base)
+	if err != nil {
+		return err
+	}
+	owner, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	uid, gid := int(owner.Uid), int(owner.Gid)
+
+	err = filepath.WalkDir(path, func(p string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, uid, gid)
+	})
+	if err != nil {
+		return err
+	}
+
+	for dir := filepath.Dir(path); isUnder(base, dir); dir = filepath.Dir(dir) {
+		if err := os.Lchown(dir, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
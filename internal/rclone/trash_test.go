@@ -0,0 +1,99 @@
+package rclone
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrashFlags(t *testing.T) {
+	env := newTestEnv()
+
+	// Test no flags when the trash is disabled
+	assert.Nil(t, trashExcludeFlags(env))
+	assert.Nil(t, trashBackupFlags(env, "--backup-dir1"))
+
+	// Test the trash is excluded and used as backup dir
+	prefix := ".s3ftp-trash"
+	env.SYNC_TRASH_PREFIX = &prefix
+	assert.Equal(t, []string{"--exclude", "/.s3ftp-trash/**"}, trashExcludeFlags(env))
+
+	flags := trashBackupFlags(env, "--backup-dir1")
+	require.Len(t, flags, 2)
+	assert.Equal(t, "--backup-dir1", flags[0])
+	assert.Regexp(t, `^s3:bucket/\.s3ftp-trash/\d{4}-\d{2}-\d{2}T\d{6}Z$`, flags[1])
+}
+
+func TestParseTrashStamps(t *testing.T) {
+	listing := "2024-06-02T100000Z/\nnot-a-stamp/\n2024-06-01T100000Z/\n"
+	assert.Equal(t, []time.Time{
+		time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC),
+		time.Date(2024, 6, 2, 10, 0, 0, 0, time.UTC),
+	}, parseTrashStamps(listing))
+}
+
+func TestPickTrashVersion(t *testing.T) {
+	stamps := []string{"2024-06-01T100000Z", "2024-06-02T100000Z", "2024-06-03T100000Z"}
+
+	// Test the latest version is picked by default
+	stamp, ok := pickTrashVersion(stamps, time.Time{})
+	assert.True(t, ok)
+	assert.Equal(t, "2024-06-03T100000Z", stamp)
+
+	// Test the version in place at the given time is picked
+	stamp, ok = pickTrashVersion(stamps, time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	assert.True(t, ok)
+	assert.Equal(t, "2024-06-02T100000Z", stamp)
+
+	// Test there is no version after the last one was trashed
+	_, ok = pickTrashVersion(stamps, time.Date(2024, 6, 4, 0, 0, 0, 0, time.UTC))
+	assert.False(t, ok)
+	_, ok = pickTrashVersion(nil, time.Time{})
+	assert.False(t, ok)
+}
+
+func TestRestoreValidation(t *testing.T) {
+	env := newTestEnv()
+
+	// Test restoring requires the trash
+	assert.ErrorContains(t, Restore(env, "user1", "a.txt", time.Time{}), "trash is disabled")
+
+	// Test the path must be inside the user directory
+	prefix := ".s3ftp-trash"
+	env.SYNC_TRASH_PREFIX = &prefix
+	assert.ErrorContains(t, Restore(env, "user1", "/", time.Time{}), "path inside the user directory")
+	assert.ErrorContains(t, Restore(env, "user1", "../..", time.Time{}), "path inside the user directory")
+
+	// Test the user must be one of SFTP_USERS
+	for _, user := range []string{"..", ".", "../etc"} {
+		assert.EqualError(t, Restore(env, user, "a.txt", time.Time{}), "invalid user", user)
+	}
+	assert.EqualError(t, Restore(env, "nobody-here", "a.txt", time.Time{}), "unknown user nobody-here")
+}
+
+func TestChownLike(t *testing.T) {
+	base := t.TempDir()
+	path := filepath.Join(base, "docs", "a.txt")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner requires root")
+	}
+	require.NoError(t, os.Chown(base, 1234, 5678))
+
+	// Test the owner of base is applied to the file and its parents
+	require.NoError(t, chownLike(base, path))
+	for _, p := range []string{path, filepath.Dir(path)} {
+		info, err := os.Stat(p)
+		require.NoError(t, err)
+		owner := info.Sys().(*syscall.Stat_t)
+		assert.Equal(t, uint32(1234), owner.Uid, p)
+		assert.Equal(t, uint32(5678), owner.Gid, p)
+	}
+}
@@ -0,0 +1,158 @@
+package rclone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"s3ftp/internal/config"
+	"s3ftp/internal/schedule"
+	"strings"
+	"time"
+)
+
+// syncRequest asks RunLoop to run a sync cycle right away, the result of the
+// cycle is sent to done
+type syncRequest struct {
+	done chan error
+}
+
+// syncRequests receives the requests while RunLoop waits for the next cycle
+var syncRequests = make(chan syncRequest)
+
+// validUser matches the SFTP user names, see SFTP_USERS
+var validUser = regexp.MustCompile(`^[a-zA-Z0-9_\-@.]+$`)
+
+// checkUser returns an error unless user is one of SFTP_USERS. Its directory
+// must be a single path element under the local root, so names like ".."
+// are refused even before they are looked up.
+func checkUser(env *config.Env, user string) error {
+	if !validUser.MatchString(user) || strings.HasPrefix(user, ".") || path.Clean(user) != user {
+		return errors.New("invalid user")
+	}
+	for _, entry := range strings.Split(*env.SFTP_USERS, ",") {
+		if name, _, _ := strings.Cut(entry, ":"); name == user {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown user %s", user)
+}
+
+// waitNext waits until t or until a sync is requested, in which case the
+// request is returned. It returns false if ctx is done first. A zero t means
+// the schedule never runs again, only a request wakes it up.
+func waitNext(ctx context.Context, t time.Time) (*syncRequest, bool) {
+	var timer <-chan time.Time
+	if !t.IsZero() {
+		tm := time.NewTimer(time.Until(t))
+		defer tm.Stop()
+		timer = tm.C
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, false
+	case <-timer:
+		return nil, true
+	case req := <-syncRequests:
+		slog.Info("sync requested, starting a cycle now")
+		return &req, true
+	}
+}
+
+// checkBlackout returns an error if t is inside a blackout window, where not
+// even the requested syncs run.
+func checkBlackout(sched *schedule.Schedule, t time.Time) error {
+	if end, blocked := sched.BlackoutEnd(t); blocked {
+		return fmt.Errorf("in a sync blackout window until %s", formatNext(end))
+	}
+	return nil
+}
+
+// runUserSync syncs only the directory of the given user: in bisync mode its
+// local files are copied to S3, in sync mode it is mirrored from S3.
+func runUserSync(env *config.Env, user string) (report, error) {
+	userDir := filepath.Join(user, user)
+	local := filepath.Join(localRoot, userDir)
+	remote := syncRemote(env) + filepath.ToSlash(userDir)
+
+	args := []string{"copy", local, remote}
+	args = append(args, trashBackupFlags(env, "--backup-dir")...)
+	args = append(args, trashExcludeFlags(env)...)
+	if *env.SYNC_MODE != "bisync" {
+		if err := checkAccess(env); err != nil {
+			return report{}, err
+		}
+		args = []string{"sync", remote, local}
+		args = append(args, maxDeleteFlags(env, countFiles(local))...)
+	}
+
+	exclude, cleanup, err := excludeInProgress(env, local)
+	if err != nil {
+		return report{}, err
+	}
+	defer cleanup()
+	args = append(args, exclude...)
+
+	rep, err := run(env, args...)
+	if err := checkDeletes(env, rep, err); err != nil {
+		return rep, fmt.Errorf("error: %w", err)
+	}
+
+	return rep, nil
+}
+
+// SyncNow runs a sync cycle right away and waits for it to finish. If user
+// is not empty only the directory of that user is synced. The runs never
+// overlap with the scheduled ones and are refused inside a blackout window.
+func SyncNow(ctx context.Context, env *config.Env, user string) error {
+	sched, err := newSchedule(env)
+	if err != nil {
+		return err
+	}
+	if err := checkBlackout(sched, time.Now()); err != nil {
+		return err
+	}
+
+	if user == "" {
+		req := syncRequest{done: make(chan error, 1)}
+		select {
+		case syncRequests <- req:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		select {
+		case err := <-req.done:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := checkUser(env, user); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(localRoot, user, user)); err != nil {
+		return fmt.Errorf("unknown user %s", user)
+	}
+
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
+	slog.Info("syncing user directory now", "user", user)
+	rep, err := runWithRetries(ctx, env, func(env *config.Env, _ bool) (report, error) {
+		return runUserSync(env, user)
+	}, false)
+	recordTransfers(rep)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("user directory synced", append(rep.logAttrs(), "user", user)...)
+	return nil
+}
@@ -0,0 +1,57 @@
+package rclone
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitNext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Test it waits until the next run
+	req, ok := waitNext(ctx, time.Now().Add(10*time.Millisecond))
+	assert.True(t, ok)
+	assert.Nil(t, req)
+
+	// Test a request wakes it up right away
+	go func() { syncRequests <- syncRequest{done: make(chan error, 1)} }()
+	req, ok = waitNext(ctx, time.Now().Add(time.Hour))
+	assert.True(t, ok)
+	assert.NotNil(t, req)
+
+	// Test it stops when ctx is done
+	cancel()
+	_, ok = waitNext(ctx, time.Time{})
+	assert.False(t, ok)
+}
+
+func TestSyncNow(t *testing.T) {
+	env := newTestEnv()
+
+	// Test a full cycle is handed over to the loop and its result returned
+	go func() {
+		req := <-syncRequests
+		req.done <- nil
+	}()
+	assert.NoError(t, SyncNow(context.Background(), env, ""))
+
+	// Test invalid and unknown users are refused
+	for _, user := range []string{"../etc", "..", ".", ".hidden", "user1/user1"} {
+		assert.EqualError(t, SyncNow(context.Background(), env, user), "invalid user", user)
+	}
+	assert.EqualError(t, SyncNow(context.Background(), env, "nobody-here"), "unknown user nobody-here")
+	assert.NoError(t, checkUser(env, "user2"))
+
+	// Test nothing runs inside a blackout window
+	now := time.Now().UTC()
+	window := now.Add(-time.Hour).Format("15:04") + "-" + now.Add(time.Hour).Format("15:04")
+	env.SYNC_BLACKOUT_WINDOWS = &window
+	err := SyncNow(context.Background(), env, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "blackout window")
+}
@@ -0,0 +1,158 @@
+package rclone
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"s3ftp/internal/config"
+	"s3ftp/internal/health"
+	"s3ftp/internal/metrics"
+	"s3ftp/internal/schedule"
+	"s3ftp/internal/watch"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// syncMu serializes the sync cycles and the pushes of changed files, so two
+// rclone processes never write to the same paths at once
+var syncMu sync.Mutex
+
+// watchMaxDelayFactor caps how long a file that keeps being written delays
+// its push, as a multiple of SYNC_WATCH_DEBOUNCE
+const watchMaxDelayFactor = 10
+
+// runPush copies the given paths, relative to the local root, to S3. Paths
+// that no longer exist are skipped by rclone, and the ones still being
+// uploaded are skipped until they are written again or the next cycle.
+func runPush(env *config.Env, paths []string) (report, error) {
+	settle, err := time.ParseDuration(*env.SYNC_SETTLE_TIME)
+	if err != nil {
+		return report{}, err
+	}
+	inProgress := inProgressFiles(localRoot, settle)
+	paths = slices.DeleteFunc(slices.Clone(paths), func(path string) bool {
+		_, found := slices.BinarySearch(inProgress, filepath.ToSlash(path))
+		return found
+	})
+	if len(paths) == 0 {
+		return report{}, nil
+	}
+
+	f, err := os.CreateTemp("", "s3ftp-files-from-*")
+	if err != nil {
+		return report{}, fmt.Errorf("error creating files-from list: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(strings.Join(paths, "\n") + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return report{}, fmt.Errorf("error writing files-from list: %w", err)
+	}
+
+	// --no-traverse avoids listing the whole bucket to copy a few files
+	args := []string{
+		"copy", localRoot, syncRemote(env),
+		"--files-from-raw", f.Name(),
+		"--no-traverse",
+	}
+	args = append(args, trashExcludeFlags(env)...)
+	args = append(args, trashBackupFlags(env, "--backup-dir")...)
+
+	rep, err := run(env, args...)
+	if err != nil {
+		return rep, fmt.Errorf("error: %w", err)
+	}
+
+	return rep, nil
+}
+
+// push pushes the changed paths to S3, it returns false to keep them pending
+// while the initial sync has not finished yet or in a blackout window.
+func push(
+	ctx context.Context, env *config.Env, sched *schedule.Schedule, paths []string,
+) bool {
+	if !health.InitialSyncDone() {
+		return false
+	}
+	// Nothing is synced inside a blackout window
+	if _, blocked := sched.BlackoutEnd(time.Now()); blocked {
+		return false
+	}
+
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
+	rep, err := runWithRetries(ctx, env, func(env *config.Env, _ bool) (report, error) {
+		return runPush(env, paths)
+	}, false)
+	recordPushMetrics(rep, err)
+	if err != nil {
+		// The next sync cycle picks up the files
+		slog.Error("S3 push of changed files failed", "error", err, "files", len(paths))
+		return true
+	}
+
+	slog.Info("S3 push of changed files completed", rep.logAttrs()...)
+	return true
+}
+
+// recordPushMetrics records the result of a push in the metrics.
+func recordPushMetrics(rep report, err error) {
+	recordTransfers(rep)
+
+	if err != nil {
+		metrics.SyncPushes.Inc(metrics.ResultFailure)
+		return
+	}
+	metrics.SyncPushes.Inc(metrics.ResultSuccess)
+}
+
+// RunWatcher watches the user directories and pushes the changed files to
+// S3 once the writes have settled for SYNC_WATCH_DEBOUNCE, so uploads don't
+// wait for the next sync cycle. Deletions are left to the sync cycles.
+//
+// When ctx is done it returns nil, the pending changes are pushed by the
+// final sync.
+func RunWatcher(ctx context.Context, env *config.Env) error {
+	debounce, err := time.ParseDuration(*env.SYNC_WATCH_DEBOUNCE)
+	if err != nil {
+		return err
+	}
+	sched, err := newSchedule(env)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("watching user directories for changes", "debounce", debounce.String())
+
+	changes := make(chan string)
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		defer close(changes)
+		return watch.Watch(egCtx, localRoot, changes)
+	})
+	eg.Go(func() error {
+		watch.Debounce(egCtx, changes, debounce, watchMaxDelayFactor*debounce,
+			func(paths []string) bool {
+				return push(egCtx, env, sched, paths)
+			},
+		)
+		return nil
+	})
+
+	if err := eg.Wait(); err != nil {
+		return fmt.Errorf("error watching user directories: %w", err)
+	}
+
+	slog.Info("watcher stopped")
+	return nil
+}
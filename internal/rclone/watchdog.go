@@ -0,0 +1,174 @@
+package rclone
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"s3ftp/internal/config"
+	"s3ftp/internal/metrics"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// killGrace is how long rclone has to exit after SIGTERM before it is killed
+const killGrace = 10 * time.Second
+
+// errRunKilled is returned when the watchdog kills a run, it is not retried
+// so the cycle counts as failed and the next one starts on schedule
+var errRunKilled = errors.New("rclone run killed")
+
+// watchdog kills an rclone run that takes longer than SYNC_TIMEOUT, or whose
+// progress stats don't change for SYNC_STALL_TIMEOUT, e.g. on a hung S3
+// connection. It also stops a bisync that plans more deletions than
+// SYNC_MAX_DELETE, before it applies them.
+type watchdog struct {
+	timeout    time.Duration
+	stall      time.Duration
+	maxDeletes int64
+
+	mu           sync.Mutex
+	last         stats
+	lastProgress time.Time
+	reason       string
+	deletes      int64
+	overLimit    chan struct{}
+}
+
+// newWatchdog returns a watchdog with the configured timeouts.
+func newWatchdog(env *config.Env) (*watchdog, error) {
+	timeout, err := time.ParseDuration(*env.SYNC_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	stall, err := time.ParseDuration(*env.SYNC_STALL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	return &watchdog{
+		timeout:      timeout,
+		stall:        stall,
+		maxDeletes:   int64(*env.SYNC_MAX_DELETE),
+		lastProgress: time.Now(),
+		overLimit:    make(chan struct{}),
+	}, nil
+}
+
+// observe records the stats reported by rclone. Any change but the elapsed
+// time counts as progress.
+func (w *watchdog) observe(s stats) {
+	s.Elapsed = 0
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if s != w.last {
+		w.last = s
+		w.lastProgress = time.Now()
+	}
+}
+
+// observeDelete records a deletion planned by bisync, which logs them all
+// before applying any. The run is stopped once there are more than
+// SYNC_MAX_DELETE.
+func (w *watchdog) observeDelete() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.deletes++
+	if w.maxDeletes > 0 && w.deletes == w.maxDeletes+1 {
+		close(w.overLimit)
+	}
+}
+
+// deletesBlocked returns the deletions planned by a run stopped for planning
+// more than SYNC_MAX_DELETE, or 0 if it was not.
+func (w *watchdog) deletesBlocked() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.maxDeletes == 0 || w.deletes <= w.maxDeletes {
+		return 0
+	}
+	return w.deletes
+}
+
+// idle returns how long ago the run last made progress.
+func (w *watchdog) idle() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Since(w.lastProgress)
+}
+
+// killed returns why the run was killed, or an empty string if it was not.
+func (w *watchdog) killed() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.reason
+}
+
+// signalGroup returns the functions that stop the process group pgid, with
+// SIGTERM and SIGKILL.
+func signalGroup(pgid int) (terminate, kill func()) {
+	terminate = func() { _ = syscall.Kill(-pgid, syscall.SIGTERM) }
+	kill = func() { _ = syscall.Kill(-pgid, syscall.SIGKILL) }
+	return terminate, kill
+}
+
+// watch stops the run when a timeout is reached, until done is closed once
+// the run has finished.
+func (w *watchdog) watch(done <-chan struct{}, terminate, kill func()) {
+	var deadline, stalled <-chan time.Time
+	if w.timeout > 0 {
+		timer := time.NewTimer(w.timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	var stallTimer *time.Timer
+	if w.stall > 0 {
+		stallTimer = time.NewTimer(w.stall)
+		defer stallTimer.Stop()
+		stalled = stallTimer.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-deadline:
+			w.stop(metrics.KillTimeout, fmt.Sprintf("run exceeded %s", w.timeout), done, terminate, kill)
+			return
+		case <-stalled:
+			if idle := w.idle(); idle < w.stall {
+				stallTimer.Reset(w.stall - idle)
+				continue
+			}
+			w.stop(metrics.KillStall, fmt.Sprintf("no progress for %s", w.stall), done, terminate, kill)
+			return
+		case <-w.overLimit:
+			// The alert is raised with the report of the run
+			halt(done, terminate, kill)
+			return
+		}
+	}
+}
+
+// stop records why the run is stopped and halts it.
+func (w *watchdog) stop(reason, msg string, done <-chan struct{}, terminate, kill func()) {
+	w.mu.Lock()
+	w.reason = msg
+	w.mu.Unlock()
+
+	metrics.SyncKills.Inc(reason)
+	slog.Error("rclone is stuck, stopping it", "reason", reason, "detail", msg)
+	halt(done, terminate, kill)
+}
+
+// halt terminates the run, and kills it if it is still running after
+// killGrace.
+func halt(done <-chan struct{}, terminate, kill func()) {
+	terminate()
+	select {
+	case <-done:
+	case <-time.After(killGrace):
+		slog.Warn("rclone did not stop, killing it")
+		kill()
+	}
+}
@@ -0,0 +1,112 @@
+package rclone
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startGroup starts a shell in its own process group that waits on a child,
+// like rclone would on a hung connection.
+func startGroup(t *testing.T) (*exec.Cmd, chan struct{}) {
+	cmd := exec.Command("sh", "-c", "sleep 30 & wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	require.NoError(t, cmd.Start())
+
+	done := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(done)
+	}()
+	return cmd, done
+}
+
+func TestWatchdogTimeout(t *testing.T) {
+	cmd, done := startGroup(t)
+	w := &watchdog{timeout: 50 * time.Millisecond, lastProgress: time.Now()}
+	terminate, kill := signalGroup(cmd.Process.Pid)
+	go w.watch(done, terminate, kill)
+
+	// Test the process group is killed once the timeout is reached, the
+	// shell only exits once its child is gone
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("process not killed")
+	}
+	assert.Equal(t, "run exceeded 50ms", w.killed())
+}
+
+func TestWatchdogStall(t *testing.T) {
+	cmd, done := startGroup(t)
+	w := &watchdog{stall: 100 * time.Millisecond, lastProgress: time.Now()}
+	terminate, kill := signalGroup(cmd.Process.Pid)
+	go w.watch(done, terminate, kill)
+
+	// Test a run making progress is not killed
+	for i := int64(1); i <= 6; i++ {
+		w.observe(stats{Bytes: i, Elapsed: float64(i)})
+		time.Sleep(40 * time.Millisecond)
+	}
+	assert.Empty(t, w.killed())
+
+	// Test the stats only changing their elapsed time are a stall
+	for i := 0; i < 6; i++ {
+		w.observe(stats{Bytes: 6, Elapsed: float64(10 + i)})
+		time.Sleep(40 * time.Millisecond)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("process not killed")
+	}
+	assert.Equal(t, "no progress for 100ms", w.killed())
+}
+
+func TestWatchdogDone(t *testing.T) {
+	w := &watchdog{timeout: time.Hour, stall: time.Hour, lastProgress: time.Now()}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		w.watch(done, func() {}, func() {})
+		close(stopped)
+	}()
+
+	// Test the watchdog stops with the run without killing anything
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("watchdog not stopped")
+	}
+	assert.Empty(t, w.killed())
+}
+
+func TestOutputTimeout(t *testing.T) {
+	env := newTestEnv()
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho listing\nsleep 60\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "rclone"), []byte(script), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// Test a command that reports no progress is stopped after the stall
+	// timeout when there is no overall timeout
+	stall := "100ms"
+	env.SYNC_STALL_TIMEOUT = &stall
+	start := time.Now()
+	_, err := output(env, "lsf", "s3:bucket/")
+	assert.ErrorIs(t, err, errRunKilled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// Test the output of a command that finishes is returned
+	fakeRclone(t, "user1/")
+	out, err := output(env, "lsf", "s3:bucket/")
+	require.NoError(t, err)
+	assert.Equal(t, "user1/\n", string(out))
+}
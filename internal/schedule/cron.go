@@ -0,0 +1,152 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// field is the set of allowed values of a cron field, bit n set means n is
+// allowed
+type field uint64
+
+func (f field) has(n int) bool {
+	return f&(1<<uint(n)) != 0
+}
+
+// fieldBounds are the minimum and maximum values of every cron field
+var fieldBounds = [5]struct{ min, max int }{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 7},  // day of week, 0 and 7 are Sunday
+}
+
+// cron is a parsed five field cron expression
+type cron struct {
+	minute, hour, dom, month, dow field
+	// domAny and dowAny are true when the field is *, as a restricted day of
+	// month and day of week match when either of them matches
+	domAny, dowAny bool
+}
+
+// parseField parses a cron field: *, values, ranges and steps separated by
+// commas, e.g. "*/5", "9-17" or "0,30".
+func parseField(expr string, min, max int) (field, error) {
+	var f field
+
+	for _, part := range strings.Split(expr, ",") {
+		rng, stepExpr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			s, err := strconv.Atoi(stepExpr)
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+			step = s
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			loExpr, hiExpr, isRange := strings.Cut(rng, "-")
+			var err error
+			lo, err = strconv.Atoi(loExpr)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiExpr); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value %q out of range %d-%d", part, min, max)
+		}
+
+		for n := lo; n <= hi; n += step {
+			f |= 1 << uint(n)
+		}
+	}
+
+	return f, nil
+}
+
+// parseCron parses a five field cron expression: minute, hour, day of month,
+// month and day of week.
+func parseCron(expr string) (cron, error) {
+	exprs := strings.Fields(expr)
+	if len(exprs) != 5 {
+		return cron{}, fmt.Errorf("invalid cron expression %q, must have 5 fields", expr)
+	}
+
+	fields := [5]field{}
+	for i, e := range exprs {
+		f, err := parseField(e, fieldBounds[i].min, fieldBounds[i].max)
+		if err != nil {
+			return cron{}, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+		fields[i] = f
+	}
+
+	// Sunday can be written as 0 or 7
+	dow := fields[4]
+	if dow.has(7) {
+		dow |= 1
+	}
+
+	return cron{
+		minute: fields[0],
+		hour:   fields[1],
+		dom:    fields[2],
+		month:  fields[3],
+		dow:    dow,
+		domAny: exprs[2] == "*",
+		dowAny: exprs[4] == "*",
+	}, nil
+}
+
+// matchDay reports whether the day of t matches the day of month and day of
+// week fields.
+func (c cron) matchDay(t time.Time) bool {
+	dom := c.dom.has(t.Day())
+	dow := c.dow.has(int(t.Weekday()))
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time strictly after t that matches the expression,
+// in the location of t, or the zero time if there is none in five years.
+func (c cron) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if !c.month.has(int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.hour.has(t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.minute.has(t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
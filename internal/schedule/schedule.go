@@ -0,0 +1,113 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	// Embed the time zone database, the image may not have one
+	_ "time/tzdata"
+)
+
+// Schedule decides when the syncs run: every interval or on cron
+// expressions, never inside a blackout window
+type Schedule struct {
+	interval  time.Duration
+	crons     []cron
+	blackouts []window
+	location  *time.Location
+}
+
+// Parse returns the schedule for the given settings. crons is a list of
+// cron expressions separated by semicolons, used instead of the interval
+// when it is not empty. blackouts is a list of windows like "Mon-Fri
+// 22:00-23:30" separated by semicolons. The crons and windows are in the
+// given time zone.
+func Parse(interval time.Duration, crons, blackouts, timezone string) (*Schedule, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %w", timezone, err)
+	}
+	s := &Schedule{interval: interval, location: location}
+
+	for _, expr := range strings.Split(crons, ";") {
+		if strings.TrimSpace(expr) == "" {
+			continue
+		}
+		c, err := parseCron(expr)
+		if err != nil {
+			return nil, err
+		}
+		s.crons = append(s.crons, c)
+	}
+	if len(s.crons) == 0 && interval <= 0 {
+		return nil, fmt.Errorf("invalid interval %s, must be greater than 0", interval)
+	}
+
+	for _, expr := range strings.Split(blackouts, ";") {
+		if strings.TrimSpace(expr) == "" {
+			continue
+		}
+		w, err := parseWindow(expr)
+		if err != nil {
+			return nil, err
+		}
+		s.blackouts = append(s.blackouts, w)
+	}
+
+	return s, nil
+}
+
+// BlackoutEnd returns the end of the blackout window containing t, and false
+// if t is not in any. With overlapping windows it is the end of the last one.
+func (s *Schedule) BlackoutEnd(t time.Time) (time.Time, bool) {
+	t = t.In(s.location)
+	found := false
+	// Bounded in case the windows cover the whole week
+	for i := 0; i < 100; i++ {
+		extended := false
+		for _, w := range s.blackouts {
+			if end, ok := w.endOf(t); ok {
+				t, found, extended = end, true, true
+			}
+		}
+		if !extended {
+			break
+		}
+	}
+	return t, found
+}
+
+// next returns the next run strictly after t, ignoring the blackouts.
+func (s *Schedule) next(t time.Time) time.Time {
+	if len(s.crons) == 0 {
+		return t.Add(s.interval)
+	}
+
+	next := time.Time{}
+	for _, c := range s.crons {
+		n := c.next(t.In(s.location))
+		if !n.IsZero() && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
+	}
+	return next
+}
+
+// Next returns the time of the next run after the run started at t. Runs
+// that fall in a blackout window are moved to its end with an interval, or
+// to the next cron run after it. It returns the zero time if the crons never
+// run again.
+func (s *Schedule) Next(t time.Time) time.Time {
+	next := s.next(t)
+	for i := 0; i < 1000 && !next.IsZero(); i++ {
+		end, blocked := s.BlackoutEnd(next)
+		if !blocked {
+			return next
+		}
+		if len(s.crons) == 0 {
+			return end
+		}
+		next = s.next(end.Add(-time.Minute))
+	}
+	return next
+}
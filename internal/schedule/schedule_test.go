@@ -0,0 +1,120 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// date returns a time in UTC, 2024-06-03 is a Monday.
+func date(day, hour, minute int) time.Time {
+	return time.Date(2024, 6, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParseField(t *testing.T) {
+	f, err := parseField("*/15", 0, 59)
+	require.NoError(t, err)
+	assert.Equal(t, field(1|1<<15|1<<30|1<<45), f)
+
+	f, err = parseField("9-11,14", 0, 23)
+	require.NoError(t, err)
+	assert.Equal(t, field(1<<9|1<<10|1<<11|1<<14), f)
+
+	f, err = parseField("10/20", 0, 59)
+	require.NoError(t, err)
+	assert.Equal(t, field(1<<10|1<<30|1<<50), f)
+
+	for _, expr := range []string{"60", "5-1", "*/0", "a", ""} {
+		_, err := parseField(expr, 0, 59)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// Every 5 minutes during business hours on weekdays
+	c, err := parseCron("*/5 9-17 * * 1-5")
+	require.NoError(t, err)
+	assert.Equal(t, date(3, 9, 5), c.next(date(3, 9, 2)))
+	assert.Equal(t, date(3, 9, 0), c.next(date(3, 8, 30)))
+	assert.Equal(t, date(4, 9, 0), c.next(date(3, 17, 55)))
+	// Saturday to Monday
+	assert.Equal(t, date(10, 9, 0), c.next(date(8, 10, 0)))
+
+	// Sunday as 7, with day of month or day of week matching
+	c, err = parseCron("0 0 1 * 7")
+	require.NoError(t, err)
+	assert.Equal(t, date(9, 0, 0), c.next(date(3, 0, 0)))
+	assert.Equal(t, time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC), c.next(date(30, 0, 0)))
+
+	// Never matching
+	c, err = parseCron("0 0 31 2 *")
+	require.NoError(t, err)
+	assert.True(t, c.next(date(3, 0, 0)).IsZero())
+
+	_, err = parseCron("* * * *")
+	assert.Error(t, err)
+}
+
+func TestWindowEndOf(t *testing.T) {
+	w, err := parseWindow("Mon-Fri 22:00-02:00")
+	require.NoError(t, err)
+
+	// Test a window spanning midnight on the day it starts and the next one
+	end, ok := w.endOf(date(3, 23, 0))
+	assert.True(t, ok)
+	assert.Equal(t, date(4, 2, 0), end)
+	end, ok = w.endOf(date(8, 1, 0))
+	assert.True(t, ok)
+	assert.Equal(t, date(8, 2, 0), end)
+
+	// Test the times outside the window
+	_, ok = w.endOf(date(3, 2, 0))
+	assert.False(t, ok)
+	_, ok = w.endOf(date(8, 23, 0))
+	assert.False(t, ok)
+
+	for _, expr := range []string{"22:00", "Mon-Fri", "Xyz 01:00-02:00", "25:00-26:00", "01:00-01:00"} {
+		_, err := parseWindow(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// Test an interval moved to the end of the blackout window
+	s, err := Parse(time.Hour, "", "Mon-Fri 22:00-23:30; 23:00-23:45", "UTC")
+	require.NoError(t, err)
+	assert.Equal(t, date(3, 21, 0), s.Next(date(3, 20, 0)))
+	assert.Equal(t, date(3, 23, 45), s.Next(date(3, 21, 30)))
+
+	// Test every 5 minutes in business hours, hourly at night, never in the
+	// batch window
+	s, err = Parse(0, "*/5 9-17 * * 1-5; 0 0-8,18-23 * * *", "Mon-Fri 20:00-21:30", "UTC")
+	require.NoError(t, err)
+	assert.Equal(t, date(3, 9, 5), s.Next(date(3, 9, 0)))
+	assert.Equal(t, date(3, 18, 0), s.Next(date(3, 17, 55)))
+	assert.Equal(t, date(3, 22, 0), s.Next(date(3, 19, 0)))
+
+	// Test the crons are evaluated in the time zone
+	s, err = Parse(0, "0 9 * * *", "", "Europe/Madrid")
+	require.NoError(t, err)
+	assert.Equal(t, date(3, 7, 0), s.Next(date(3, 0, 0)).UTC())
+
+	_, err = Parse(0, "", "", "UTC")
+	assert.Error(t, err)
+	_, err = Parse(time.Hour, "", "", "Mars/Olympus")
+	assert.Error(t, err)
+}
+
+func TestBlackoutEnd(t *testing.T) {
+	s, err := Parse(time.Hour, "", "Sat,Sun 00:00-12:00", "UTC")
+	require.NoError(t, err)
+
+	end, ok := s.BlackoutEnd(date(8, 6, 0))
+	assert.True(t, ok)
+	assert.Equal(t, date(8, 12, 0), end)
+
+	_, ok = s.BlackoutEnd(date(3, 6, 0))
+	assert.False(t, ok)
+}
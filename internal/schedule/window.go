@@ -0,0 +1,128 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdays maps the day names accepted in a window to time.Weekday
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// window is a daily time range, in minutes since midnight, on the given days
+// of the week. A window that ends before it starts spans midnight and the
+// days are the ones it starts on.
+type window struct {
+	days       [7]bool
+	start, end int
+}
+
+// parseDays parses the days of a window: a day, a range or a comma separated
+// list of them, e.g. "Mon-Fri" or "Sat,Sun".
+func parseDays(expr string) ([7]bool, error) {
+	days := [7]bool{}
+
+	for _, part := range strings.Split(strings.ToLower(expr), ",") {
+		loExpr, hiExpr, isRange := strings.Cut(part, "-")
+		lo, ok := weekdays[loExpr]
+		if !ok {
+			return days, fmt.Errorf("invalid day %q", part)
+		}
+		hi := lo
+		if isRange {
+			if hi, ok = weekdays[hiExpr]; !ok {
+				return days, fmt.Errorf("invalid day %q", part)
+			}
+		}
+
+		for d := lo; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == hi {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// parseClock parses a HH:MM time into minutes since midnight.
+func parseClock(expr string) (int, error) {
+	t, err := time.Parse("15:04", expr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, must be HH:MM", expr)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseWindow parses a window, an optional list of days followed by a time
+// range, e.g. "Mon-Fri 22:00-23:30" or "01:00-02:00".
+func parseWindow(expr string) (window, error) {
+	w := window{days: [7]bool{true, true, true, true, true, true, true}}
+
+	parts := strings.Fields(expr)
+	if len(parts) == 2 {
+		days, err := parseDays(parts[0])
+		if err != nil {
+			return window{}, fmt.Errorf("invalid window %q: %w", expr, err)
+		}
+		w.days = days
+		parts = parts[1:]
+	}
+	if len(parts) != 1 {
+		return window{}, fmt.Errorf("invalid window %q, must be [days] HH:MM-HH:MM", expr)
+	}
+
+	startExpr, endExpr, ok := strings.Cut(parts[0], "-")
+	if !ok {
+		return window{}, fmt.Errorf("invalid window %q, must be [days] HH:MM-HH:MM", expr)
+	}
+	var err error
+	if w.start, err = parseClock(startExpr); err != nil {
+		return window{}, fmt.Errorf("invalid window %q: %w", expr, err)
+	}
+	if w.end, err = parseClock(endExpr); err != nil {
+		return window{}, fmt.Errorf("invalid window %q: %w", expr, err)
+	}
+	if w.start == w.end {
+		return window{}, fmt.Errorf("invalid window %q, it is empty", expr)
+	}
+
+	return w, nil
+}
+
+// endOf returns the end of the window containing t, and false if t is not in
+// the window.
+func (w window) endOf(t time.Time) (time.Time, bool) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	minute := t.Hour()*60 + t.Minute()
+	at := func(day time.Time, minutes int) time.Time {
+		return day.Add(time.Duration(minutes) * time.Minute)
+	}
+
+	if w.start < w.end {
+		if w.days[t.Weekday()] && minute >= w.start && minute < w.end {
+			return at(midnight, w.end), true
+		}
+		return time.Time{}, false
+	}
+
+	// Spanning midnight, t is either in the part started today or in the
+	// part started yesterday
+	if w.days[t.Weekday()] && minute >= w.start {
+		return at(midnight.AddDate(0, 0, 1), w.end), true
+	}
+	yesterday := midnight.AddDate(0, 0, -1)
+	if w.days[yesterday.Weekday()] && minute < w.end {
+		return at(midnight, w.end), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,67 @@
+package sftp
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// activeSessions returns the PIDs of the sshd processes serving SFTP
+// sessions. They keep running after the sshd listener has exited.
+func activeSessions() []int {
+	pids := []int{}
+
+	cmdlines, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+	for _, path := range cmdlines {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		// sshd sets the process title to e.g. "sshd: user@notty"
+		title := string(b)
+		if !strings.HasPrefix(title, "sshd: ") && !strings.HasPrefix(title, "sshd-session: ") {
+			continue
+		}
+		if strings.Contains(title, "[listener]") {
+			continue
+		}
+
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(path)))
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+
+	return pids
+}
+
+// drainSessions waits for the active SFTP sessions to finish, up to the
+// given timeout, and terminates the ones still running after it.
+func drainSessions(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		pids := activeSessions()
+		if len(pids) == 0 {
+			slog.Info("all SFTP sessions finished")
+			return
+		}
+
+		if time.Now().After(deadline) {
+			slog.Warn("terminating SFTP sessions still running", "sessions", len(pids))
+			for _, pid := range pids {
+				_ = syscall.Kill(pid, syscall.SIGTERM)
+			}
+			return
+		}
+
+		slog.Info("waiting for SFTP sessions to finish", "sessions", len(pids))
+		time.Sleep(time.Second)
+	}
+}
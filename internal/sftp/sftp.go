@@ -8,6 +8,8 @@ import (
 	"os"
 	"os/exec"
 	"s3ftp/internal/config"
+	"s3ftp/internal/health"
+	"s3ftp/internal/metrics"
 	"strings"
 )
 
@@ -32,11 +34,16 @@ Match User %s
 	X11Forwarding no
 `
 
+// snapshotRoot is the directory holding the snapshot users chroots, outside
+// of the synced /home so nothing in it is ever written back to S3
+const snapshotRoot = "/snapshots"
+
 // usersGroup is the group that all users belong to
 const usersGroup = "s3ftp-users"
 
-// writeInitialSSHConfig writes the initial sshd_config file to /etc/ssh/sshd_config
-func writeInitialSSHConfig() error {
+// writeInitialSSHConfig writes the initial sshd_config file to /etc/ssh/sshd_config,
+// refusing SFTP logins with a banner if hold is true
+func writeInitialSSHConfig(hold bool) error {
 	sshdDir := "/etc/ssh"
 	sshdPath := "/etc/ssh/sshd_config"
 
@@ -63,6 +70,16 @@ func writeInitialSSHConfig() error {
 		return fmt.Errorf("error writing to sshd_config: %w", err)
 	}
 
+	if hold {
+		if err := writeHoldBanner(); err != nil {
+			return err
+		}
+		_, err = f.WriteString(holdConfig)
+		if err != nil {
+			return fmt.Errorf("error writing to sshd_config: %w", err)
+		}
+	}
+
 	slog.Info("initial sshd_config written")
 	return nil
 }
@@ -134,53 +151,100 @@ func addUser(user, password string, isReadOnly bool) error {
 	if isReadOnly {
 		template = sshUserTemplateRO
 	}
-	sshdUserConfig := fmt.Sprintf(template, user, chrootDir)
+	if err := writeUserConfig(template, user, chrootDir); err != nil {
+		return err
+	}
+
+	if isReadOnly {
+		slog.Info(fmt.Sprintf("user %s added as ro user", user))
+	} else {
+		slog.Info(fmt.Sprintf("user %s added as rw user", user))
+	}
+
+	return nil
+}
+
+// writeUserConfig adds the Match block of a user to the sshd_config file
+func writeUserConfig(template, user, chrootDir string) error {
 	f, err := os.OpenFile("/etc/ssh/sshd_config", os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("error opening sshd_config: %w", err)
 	}
 	defer f.Close()
-	_, err = f.WriteString(sshdUserConfig)
+	_, err = f.WriteString(fmt.Sprintf(template, user, chrootDir))
 	if err != nil {
 		return fmt.Errorf("error writing to sshd_config: %w", err)
 	}
+	return nil
+}
 
-	if isReadOnly {
-		slog.Info(fmt.Sprintf("user %s added as ro user", user))
-	} else {
-		slog.Info(fmt.Sprintf("user %s added as rw user", user))
+// addSnapshotUser adds a read-only user chrooted into the snapshot directory,
+// which is owned by root so only the rclone snapshot can write to it. The
+// user has no password, so it can't log in until EnableSnapshotUser is
+// called once the snapshot is populated.
+func addSnapshotUser(user string) error {
+	chrootDir := fmt.Sprintf("%s/%s", snapshotRoot, user)
+	userDir := fmt.Sprintf("%s/%s/%s", snapshotRoot, user, user)
+
+	commands := []command{
+		{
+			name: "create snapshot dir",
+			cmd:  fmt.Sprintf("mkdir -p %s", userDir),
+		},
+		{
+			name: "add user",
+			cmd: fmt.Sprintf(
+				"adduser -D -h %s -s /sbin/nologin -G %s %s", chrootDir, usersGroup, user,
+			),
+		},
+		{
+			name: "set snapshot dir ownership",
+			cmd:  fmt.Sprintf("chown -R root:root %s", chrootDir),
+		},
+		{
+			name: "set snapshot dir permissions",
+			cmd:  fmt.Sprintf("chmod 755 %s %s", chrootDir, userDir),
+		},
+	}
+
+	for _, cmd := range commands {
+		_, err := execNamedCMD(cmd)
+		if err != nil {
+			return err
+		}
 	}
 
+	if err := writeUserConfig(sshUserTemplateRO, user, chrootDir); err != nil {
+		return err
+	}
+
+	slog.Info(fmt.Sprintf("user %s added as snapshot user", user))
 	return nil
 }
 
-// generateSSHKeys generates the necessary keys for the sftp server
-func generateSSHKeys() error {
-	_, err := exec.Command("ssh-keygen", "-A").Output()
+// EnableSnapshotUser sets the password of a snapshot user, so it can log in
+// once its snapshot is populated.
+func EnableSnapshotUser(user, password string) error {
+	_, err := execNamedCMD(command{
+		name: "set user password",
+		cmd:  fmt.Sprintf(`echo "%s:%s" | chpasswd`, user, password),
+	})
 	if err != nil {
-		return fmt.Errorf("error generating ssh keys: %w", err)
+		return err
 	}
 
-	slog.Info("ssh keys generated")
+	slog.Info(fmt.Sprintf("snapshot user %s enabled", user))
 	return nil
 }
 
-// StartSSHD starts the sshd service
-func StartSSHD() error {
-	cmd := exec.Command("/usr/sbin/sshd", "-D")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("error starting sshd: %w", err)
-	}
-	slog.Info("sshd started")
-
-	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("error waiting for sshd to finish: %w", err)
+// generateSSHKeys generates the necessary keys for the sftp server
+func generateSSHKeys() error {
+	_, err := exec.Command("ssh-keygen", "-A").Output()
+	if err != nil {
+		return fmt.Errorf("error generating ssh keys: %w", err)
 	}
-	slog.Info("sshd finished")
 
+	slog.Info("ssh keys generated")
 	return nil
 }
 
@@ -217,12 +281,23 @@ func SetupSFTP(env *config.Env) error {
 		}
 	}
 
-	err := generateSSHKeys()
+	snapshotUsers, err := config.SnapshotUsers(env)
+	if err != nil {
+		return err
+	}
+	for _, user := range snapshotUsers {
+		usernames[user.Username]++
+		if usernames[user.Username] > 1 {
+			return fmt.Errorf("duplicate username: %s", user.Username)
+		}
+	}
+
+	err = generateSSHKeys()
 	if err != nil {
 		return fmt.Errorf("generate-ssh-keys: %w", err)
 	}
 
-	err = writeInitialSSHConfig()
+	err = writeInitialSSHConfig(*env.SFTP_STARTUP_MODE == config.SFTPStartupHold)
 	if err != nil {
 		return fmt.Errorf("write-initial-ssh-config: %w", err)
 	}
@@ -238,6 +313,14 @@ func SetupSFTP(env *config.Env) error {
 			return fmt.Errorf("add-user(%s): %w", user.Username, err)
 		}
 	}
+	for _, user := range snapshotUsers {
+		err = addSnapshotUser(user.Username)
+		if err != nil {
+			return fmt.Errorf("add-snapshot-user(%s): %w", user.Username, err)
+		}
+	}
+	metrics.Users.Set(float64(len(users) + len(snapshotUsers)))
+	health.SetUsersProvisioned()
 
 	return nil
 }
@@ -269,6 +352,10 @@ func ResetSFTP() error {
 			name: "delete sshd_config",
 			cmd:  "rm -f /etc/ssh/sshd_config",
 		},
+		{
+			name: "delete hold banner",
+			cmd:  fmt.Sprintf("rm -f %s", holdBannerPath),
+		},
 	}
 
 	for _, cmd := range commands {
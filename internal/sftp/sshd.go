@@ -0,0 +1,201 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"s3ftp/internal/backoff"
+	"s3ftp/internal/config"
+	"s3ftp/internal/health"
+	"s3ftp/internal/metrics"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Backoff between sshd restarts
+const (
+	sshdRestartBackoff    = time.Second
+	sshdRestartMaxBackoff = 30 * time.Second
+)
+
+// sshdProcess holds the running sshd process, which changes on every restart
+type sshdProcess struct {
+	mu      sync.Mutex
+	process *os.Process
+}
+
+func (s *sshdProcess) set(p *os.Process) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.process = p
+}
+
+// signal sends the signal to the running sshd process, if any.
+func (s *sshdProcess) signal(sig os.Signal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.process == nil {
+		return nil
+	}
+	return s.process.Signal(sig)
+}
+
+// validateSSHDConfig checks the sshd configuration with sshd -t.
+func validateSSHDConfig() error {
+	out, err := exec.Command("/usr/sbin/sshd", "-t").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("invalid sshd configuration: %w: %s", err, out)
+	}
+	return nil
+}
+
+// runSSHD runs sshd until it exits. When ctx is done the sshd listener is
+// stopped, the sessions are separate processes and keep running.
+func runSSHD(ctx context.Context, current *sshdProcess) error {
+	cmd := exec.Command("/usr/sbin/sshd", "-D")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting sshd: %w", err)
+	}
+	current.set(cmd.Process)
+	defer current.set(nil)
+
+	slog.Info("sshd started")
+	metrics.SSHDUp.Set(1)
+	health.SetSSHDRunning(true)
+
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-ctx.Done():
+			slog.Info("stopping sshd listener, no new logins will be accepted")
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+		case <-exited:
+		}
+	}()
+
+	err := cmd.Wait()
+	metrics.SSHDUp.Set(0)
+	health.SetSSHDRunning(false)
+
+	if err != nil {
+		return fmt.Errorf("error waiting for sshd to finish: %w", err)
+	}
+	return nil
+}
+
+// StartSSHD starts and supervises the sshd service
+//
+// Depending on SFTP_STARTUP_MODE, sshd is started only after the initial
+// sync (delay) or started refusing logins until then (hold).
+//
+// The configuration is validated with sshd -t before every start, and sshd
+// is restarted with backoff whenever it exits. It gives up after
+// SSHD_MAX_RESTARTS restarts in a row where sshd did not stay up for
+// SSHD_RESTART_WINDOW.
+//
+// When ctx is done the sshd listener is stopped so no new logins are
+// accepted, and it returns nil once the active sessions have finished or
+// SHUTDOWN_DRAIN_TIMEOUT has elapsed.
+func StartSSHD(ctx context.Context, env *config.Env) error {
+	drainTimeout, err := time.ParseDuration(*env.SHUTDOWN_DRAIN_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	restartWindow, err := time.ParseDuration(*env.SSHD_RESTART_WINDOW)
+	if err != nil {
+		return err
+	}
+
+	mode := *env.SFTP_STARTUP_MODE
+	if mode == config.SFTPStartupDelay {
+		if err := waitForInitialSync(ctx, env); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+
+	// ctx is canceled by the hold goroutine when logins can't be released,
+	// after it has sent the reason to holdErr
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	holdErr := make(chan error, 1)
+
+	current := &sshdProcess{}
+	if mode == config.SFTPStartupHold {
+		go func() {
+			err := waitForInitialSync(ctx, env)
+			if err == nil && ctx.Err() == nil {
+				err = releaseLogins(current.signal)
+			}
+			if err != nil && ctx.Err() == nil {
+				holdErr <- err
+				cancel()
+			}
+		}()
+	}
+
+	// shutdown returns the error that stopped the hold goroutine, if any, or
+	// waits for the sessions to finish on any other shutdown, including one
+	// caused by another service failing
+	shutdown := func() error {
+		select {
+		case err := <-holdErr:
+			return err
+		default:
+		}
+		drainSessions(drainTimeout)
+		return nil
+	}
+
+	restarts := 0
+	for {
+		startedAt := time.Now()
+		cause := "exited"
+		err := validateSSHDConfig()
+		if err != nil {
+			cause = "invalid_config"
+		} else {
+			err = runSSHD(ctx, current)
+		}
+
+		if ctx.Err() != nil {
+			return shutdown()
+		}
+		if err == nil {
+			err = errors.New("sshd exited")
+		}
+
+		// sshd ran long enough to not be considered a crash loop
+		if time.Since(startedAt) >= restartWindow {
+			restarts = 0
+		}
+		restarts++
+		if restarts > *env.SSHD_MAX_RESTARTS {
+			return fmt.Errorf("sshd crash loop, gave up after %d restarts: %w", restarts-1, err)
+		}
+
+		metrics.SSHDRestarts.Inc(cause)
+		wait := backoff.Delay(restarts, sshdRestartBackoff, sshdRestartMaxBackoff)
+		slog.Error(
+			"sshd stopped, restarting",
+			"error", err,
+			"cause", cause,
+			"restarts", restarts,
+			"max_restarts", *env.SSHD_MAX_RESTARTS,
+			"restart_in", wait.String(),
+		)
+		if !backoff.Sleep(ctx, wait) {
+			return shutdown()
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"s3ftp/internal/config"
+	"s3ftp/internal/health"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// holdBannerPath is the banner shown to users while logins are held
+const holdBannerPath = "/etc/ssh/s3ftp_hold_banner"
+
+// holdBanner is the message shown to users while logins are held
+const holdBanner = `
+s3ftp is synchronizing your files from storage.
+Logins are disabled until the first synchronization finishes,
+please try again in a few minutes.
+
+`
+
+// Markers around the sshd_config block that refuses logins, so it can be
+// removed once the initial sync has finished
+const (
+	holdBegin = "# s3ftp:hold-begin"
+	holdEnd   = "# s3ftp:hold-end"
+)
+
+// holdConfig is added to the global section of sshd_config to refuse the
+// logins of every SFTP user with a banner explaining why
+var holdConfig = fmt.Sprintf(`
+%s
+Banner %s
+DenyGroups %s
+%s
+`, holdBegin, holdBannerPath, usersGroup, holdEnd)
+
+// writeHoldBanner writes the banner shown while logins are held.
+func writeHoldBanner() error {
+	if err := os.WriteFile(holdBannerPath, []byte(holdBanner), 0644); err != nil {
+		return fmt.Errorf("error writing hold banner: %w", err)
+	}
+	return nil
+}
+
+// removeHoldConfig returns the sshd_config content without the hold block.
+func removeHoldConfig(content string) string {
+	start := strings.Index(content, holdBegin)
+	end := strings.Index(content, holdEnd)
+	if start == -1 || end == -1 || end < start {
+		return content
+	}
+	return content[:start] + strings.TrimPrefix(content[end+len(holdEnd):], "\n")
+}
+
+// releaseLogins removes the hold block from sshd_config and makes sshd reload
+// it through the given signal function, so SFTP users can log in from then on.
+func releaseLogins(signal func(os.Signal) error) error {
+	sshdPath := "/etc/ssh/sshd_config"
+
+	b, err := os.ReadFile(sshdPath)
+	if err != nil {
+		return fmt.Errorf("error reading sshd_config: %w", err)
+	}
+	if err := os.WriteFile(sshdPath, []byte(removeHoldConfig(string(b))), 0644); err != nil {
+		return fmt.Errorf("error writing sshd_config: %w", err)
+	}
+
+	// sshd re-executes itself with the new configuration on SIGHUP
+	if err := signal(syscall.SIGHUP); err != nil {
+		return fmt.Errorf("error reloading sshd: %w", err)
+	}
+
+	slog.Info("SFTP logins enabled")
+	return nil
+}
+
+// waitForInitialSync blocks until the initial sync has finished or
+// SFTP_STARTUP_TIMEOUT has elapsed, in which case SFTP_STARTUP_FALLBACK
+// decides whether to carry on (nil) or to fail. It returns nil right away
+// when ctx is done.
+func waitForInitialSync(ctx context.Context, env *config.Env) error {
+	timeout, err := time.ParseDuration(*env.SFTP_STARTUP_TIMEOUT)
+	if err != nil {
+		return err
+	}
+
+	slog.Info(
+		"waiting for the initial sync before accepting SFTP logins",
+		"mode", *env.SFTP_STARTUP_MODE,
+		"timeout", *env.SFTP_STARTUP_TIMEOUT,
+	)
+
+	select {
+	case <-health.InitialSync():
+		return nil
+	case <-ctx.Done():
+		return nil
+	case <-time.After(timeout):
+	}
+
+	if *env.SFTP_STARTUP_FALLBACK == config.SFTPStartupFallbackExit {
+		return errors.New("timed out waiting for the initial sync")
+	}
+
+	slog.Warn(
+		"timed out waiting for the initial sync, accepting SFTP logins anyway",
+		"timeout", *env.SFTP_STARTUP_TIMEOUT,
+	)
+	return nil
+}
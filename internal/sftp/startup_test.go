@@ -0,0 +1,20 @@
+package sftp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveHoldConfig(t *testing.T) {
+	base := "Port 22\nMaxAuthTries 5\n"
+	users := "\nMatch User user1\n  ChrootDirectory /home/user1\n"
+
+	// Test the hold block is removed and the rest is kept as is
+	content := base + holdConfig + users
+	assert.Contains(t, content, "DenyGroups "+usersGroup)
+	assert.Equal(t, base+"\n"+users, removeHoldConfig(content))
+
+	// Test a config without hold block is not modified
+	assert.Equal(t, base+users, removeHoldConfig(base+users))
+}
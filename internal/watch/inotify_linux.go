@@ -0,0 +1,134 @@
+package watch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// watchMask are the inotify events watched on every directory. Deletions are
+// not watched, the periodic sync propagates them.
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE
+
+// watcher keeps track of the inotify watches, one per directory
+type watcher struct {
+	fd   int
+	root string
+	dirs map[int32]string
+}
+
+// add watches dir and its subdirectories. When notify is true the files
+// found are sent to changes, as they may have been written before the
+// directory was watched.
+func (w *watcher) add(ctx context.Context, dir string, notify bool, changes chan<- string) {
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if !d.IsDir() {
+			if notify && d.Type().IsRegular() {
+				w.send(ctx, path, changes)
+			}
+			return nil
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			// e.g. fs.inotify.max_user_watches reached, the periodic sync
+			// still picks up the changes in this directory
+			slog.Warn("error watching directory", "path", path, "error", err)
+			return nil
+		}
+		w.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+// send sends the path, relative to the root, to changes.
+func (w *watcher) send(ctx context.Context, path string, changes chan<- string) {
+	rel, err := filepath.Rel(w.root, path)
+	if err != nil {
+		return
+	}
+
+	select {
+	case changes <- rel:
+	case <-ctx.Done():
+	}
+}
+
+// Watch watches root and its subdirectories with inotify and sends the path
+// of every file written, moved or created in them, relative to root, to
+// changes. New directories are watched as they are created.
+//
+// It returns nil when ctx is done.
+func Watch(ctx context.Context, root string, changes chan<- string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("error initializing inotify: %w", err)
+	}
+
+	// The non blocking fd goes through the runtime poller, so closing the
+	// file interrupts a pending read
+	f := os.NewFile(uintptr(fd), "inotify")
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = f.Close()
+	}()
+
+	w := &watcher{fd: fd, root: root, dirs: map[int32]string{}}
+	w.add(ctx, root, false, changes)
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, os.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("error reading inotify events: %w", err)
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			offset = nameStart + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				slog.Warn("inotify event queue overflowed, some changes wait for the next sync")
+				continue
+			}
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, event.Wd)
+				continue
+			}
+
+			dir, ok := w.dirs[event.Wd]
+			if !ok || event.Len == 0 {
+				continue
+			}
+			name := string(bytes.TrimRight(buf[nameStart:offset], "\x00"))
+			path := filepath.Join(dir, name)
+
+			switch {
+			case event.Mask&syscall.IN_ISDIR != 0:
+				w.add(ctx, path, true, changes)
+			case event.Mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0:
+				w.send(ctx, path, changes)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package watch
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// Debounce collects the paths received from changes and calls push with
+// them once no change has been received for delay, or maxDelay after the
+// first pending change, so a file that keeps being written is still pushed.
+//
+// The paths are deduplicated and sorted. When push returns false they are
+// kept pending and pushed again after delay together with the new changes.
+//
+// It returns when ctx is done or changes is closed, without pushing the
+// pending paths.
+func Debounce(
+	ctx context.Context, changes <-chan string, delay, maxDelay time.Duration,
+	push func(paths []string) bool,
+) {
+	pending := map[string]struct{}{}
+	var first time.Time
+
+	timer := time.NewTimer(delay)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case path, ok := <-changes:
+			if !ok {
+				return
+			}
+			if len(pending) == 0 {
+				first = time.Now()
+			}
+			pending[path] = struct{}{}
+
+			// Drain a tick that fired while receiving the change, so it
+			// doesn't push before the new delay
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			wait := min(delay, maxDelay-time.Since(first))
+			timer.Reset(max(wait, 0))
+
+		case <-timer.C:
+			paths := make([]string, 0, len(pending))
+			for path := range pending {
+				paths = append(paths, path)
+			}
+			slices.Sort(paths)
+
+			if !push(paths) {
+				first = time.Now()
+				timer.Reset(delay)
+				continue
+			}
+			clear(pending)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package watch
+
+import (
+	"context"
+	"errors"
+)
+
+// Watch is only supported on Linux, where it uses inotify.
+func Watch(_ context.Context, _ string, _ chan<- string) error {
+	return errors.ErrUnsupported
+}
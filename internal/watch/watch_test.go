@@ -0,0 +1,114 @@
+package watch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := make(chan string)
+	pushed := make(chan []string, 10)
+	var ready atomic.Bool
+	go Debounce(ctx, changes, 20*time.Millisecond, time.Second, func(paths []string) bool {
+		pushed <- paths
+		return ready.Load()
+	})
+
+	// Test a burst of changes is pushed once, deduplicated and sorted
+	changes <- "b"
+	changes <- "a"
+	changes <- "b"
+	assert.Equal(t, []string{"a", "b"}, <-pushed)
+
+	// Test the paths are kept pending until a push succeeds
+	assert.Equal(t, []string{"a", "b"}, <-pushed)
+	ready.Store(true)
+	changes <- "c"
+	assert.Equal(t, []string{"a", "b", "c"}, <-pushed)
+
+	select {
+	case paths := <-pushed:
+		t.Fatalf("unexpected push: %v", paths)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDebounceMaxDelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := make(chan string)
+	pushed := make(chan []string, 10)
+	go Debounce(ctx, changes, time.Hour, 30*time.Millisecond, func(paths []string) bool {
+		pushed <- paths
+		return true
+	})
+
+	// Test the changes are pushed after maxDelay even if they keep coming
+	changes <- "a"
+	select {
+	case paths := <-pushed:
+		assert.Equal(t, []string{"a"}, paths)
+	case <-time.After(time.Second):
+		t.Fatal("changes were not pushed after maxDelay")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("inotify is only available on Linux")
+	}
+
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "user", "user"), 0755))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan string, 10)
+	errc := make(chan error, 1)
+	go func() { errc <- Watch(ctx, root, changes) }()
+
+	next := func() string {
+		select {
+		case path := <-changes:
+			return path
+		case <-time.After(time.Second):
+			t.Fatal("no change received")
+			return ""
+		}
+	}
+
+	// Give the watcher time to add the initial watches
+	time.Sleep(50 * time.Millisecond)
+
+	// Test a file written in an existing directory is reported
+	path := filepath.Join(root, "user", "user", "file.txt")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0644))
+	assert.Equal(t, filepath.Join("user", "user", "file.txt"), next())
+
+	// Test the files of a new directory are reported and it is watched
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "user", "user", "dir"), 0755))
+	time.Sleep(50 * time.Millisecond)
+	path = filepath.Join(root, "user", "user", "dir", "nested.txt")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0644))
+	assert.Equal(t, filepath.Join("user", "user", "dir", "nested.txt"), next())
+
+	// Test it stops when ctx is done
+	cancel()
+	select {
+	case err := <-errc:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("watch did not stop")
+	}
+}